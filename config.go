@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"lesiw.io/testdetect/detect"
+)
+
+// configName is the name of the file that lists the packages to generate
+// into when testdetect runs without package patterns.
+const configName = "testdetect.json"
+
+// A config is the contents of a testdetect.json file.
+type config struct {
+	Targets []target `json:"targets"`
+}
+
+// A target is a set of packages generated into with the same options.
+// Patterns are interpreted relative to the directory of the config file,
+// and empty options keep their defaults.
+type target struct {
+	Patterns []string `json:"patterns"`
+	Type     string   `json:"type"`
+	Method   string   `json:"method"`
+	Mode     string   `json:"mode"`
+	Compiler string   `json:"compiler"`
+}
+
+// findConfig returns the path of the config file in dir or the nearest
+// directory above it, up to the root of the enclosing module or workspace,
+// or "" if there is none.
+func findConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, configName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		for _, root := range []string{"go.mod", "go.work"} {
+			if _, err := os.Stat(filepath.Join(dir, root)); err == nil {
+				return "", nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// readConfig reads the config file at path.
+func readConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if len(c.Targets) == 0 {
+		return nil, fmt.Errorf("%s lists no targets", path)
+	}
+	for i, t := range c.Targets {
+		if len(t.Patterns) == 0 {
+			return nil, fmt.Errorf("%s: target %d has no patterns", path, i)
+		}
+	}
+	return &c, nil
+}
+
+// generator returns a copy of g with the options of t applied, except for
+// those named in set, which were given on the command line.
+func (t target) generator(
+	g detect.Generator, set map[string]bool,
+) *detect.Generator {
+	if t.Type != "" && !set["type"] {
+		g.Type = t.Type
+	}
+	if t.Method != "" && !set["method"] {
+		g.Method = t.Method
+	}
+	if t.Mode != "" && !set["mode"] {
+		g.Mode = detect.Mode(t.Mode)
+	}
+	if t.Compiler != "" && !set["compiler"] {
+		g.Compiler = t.Compiler
+	}
+	return &g
+}
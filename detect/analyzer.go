@@ -0,0 +1,151 @@
+package detect
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// Analyzer reports uses of the detector method, under its default names,
+// that do not behave as they appear to:
+//
+//   - references to the testing package in a branch that only runs when
+//     the detector method reports false, such as the body of
+//     if !t.Testing() { ... }, which never runs in tests and links the
+//     testing package into the program binary;
+//   - package-level variables of a main package initialized with the
+//     detector method's result, whose value the compiler cannot treat as
+//     a constant, so branches on them stay in the program binary.
+//
+// The -type and -method flags select other names, as for the generator.
+// Test files and generated files are not checked. Analyzer can be run with
+// go vet -vettool through [golang.org/x/tools/go/analysis/unitchecker].
+var Analyzer = &analysis.Analyzer{
+	Name: "testdetect",
+	Doc:  "report detector method calls that do not behave as intended",
+	Run:  analyze,
+}
+
+var analyzerType, analyzerMethod string
+
+func init() {
+	Analyzer.Flags.StringVar(&analyzerType, "type", DefaultType,
+		"name of the detector type")
+	Analyzer.Flags.StringVar(&analyzerMethod, "method", DefaultMethod,
+		"name of the detector method")
+}
+
+func analyze(pass *analysis.Pass) (any, error) {
+	obj, _ := pass.Pkg.Scope().Lookup(analyzerType).(*types.TypeName)
+	if obj == nil {
+		return nil, nil
+	}
+	detects := func(x ast.Expr) bool { return detectorCall(pass, obj, x) }
+	for _, f := range pass.Files {
+		name := pass.Fset.File(f.Pos()).Name()
+		if strings.HasSuffix(name, "_test.go") || ast.IsGenerated(f) {
+			continue
+		}
+		if pass.Pkg.Name() == "main" {
+			packageVars(pass, f, detects)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			if stmt, ok := n.(*ast.IfStmt); ok {
+				if outside := falseBranch(stmt, detects); outside != nil {
+					testingRefs(pass, outside)
+				}
+			}
+			return true
+		})
+	}
+	return nil, nil
+}
+
+// detectorCall reports whether x is a call to the detector method on the
+// detector type obj.
+func detectorCall(pass *analysis.Pass, obj *types.TypeName, x ast.Expr) bool {
+	call, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != analyzerMethod {
+		return false
+	}
+	s, ok := pass.TypesInfo.Selections[sel]
+	if !ok || s.Kind() != types.MethodVal {
+		return false
+	}
+	return isDetector(s.Recv(), obj)
+}
+
+// falseBranch returns the branch of stmt that runs when the detector
+// method reports false, if stmt branches on it.
+func falseBranch(stmt *ast.IfStmt, detects func(ast.Expr) bool) ast.Stmt {
+	switch cond := ast.Unparen(stmt.Cond).(type) {
+	case *ast.UnaryExpr:
+		if cond.Op == token.NOT && detects(cond.X) {
+			return stmt.Body
+		}
+	default:
+		if detects(cond) {
+			return stmt.Else
+		}
+	}
+	return nil
+}
+
+// packageVars reports the package-level variables in f initialized with a
+// call to the detector method.
+func packageVars(
+	pass *analysis.Pass, f *ast.File, detects func(ast.Expr) bool,
+) {
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, v := range vs.Values {
+				if i >= len(vs.Names) || !detects(v) {
+					continue
+				}
+				pass.Reportf(vs.Names[i].Pos(),
+					"%s holds the result of %s.%s() in a variable, "+
+						"so branches on it are not removed from the "+
+						"program binary; call %s directly",
+					vs.Names[i].Name, analyzerType, analyzerMethod,
+					analyzerMethod)
+			}
+		}
+	}
+}
+
+// testingRefs reports references to the testing package in n, which only
+// runs when the detector method reports false.
+func testingRefs(pass *analysis.Pass, n ast.Node) {
+	ast.Inspect(n, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		id, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		pkg, ok := pass.TypesInfo.Uses[id].(*types.PkgName)
+		if !ok || pkg.Imported().Path() != "testing" {
+			return true
+		}
+		pass.Reportf(sel.Pos(),
+			"testing.%s is only reached when %s.%s() is false, "+
+				"so it never runs in tests but is linked into the "+
+				"program binary",
+			sel.Sel.Name, analyzerType, analyzerMethod)
+		return false
+	})
+}
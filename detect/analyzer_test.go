@@ -0,0 +1,58 @@
+package detect
+
+import (
+	"testing"
+
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+func TestAnalyzer(t *testing.T) {
+	dir := t.TempDir()
+	// A hand-written stand-in for the generated files, which the analyzer
+	// skips anyway.
+	writeFile(t, dir, "src/a/detector.go", []byte(`package main
+
+type testingDetector struct{}
+
+func (testingDetector) Testing() bool { return false }
+`))
+	writeFile(t, dir, "src/a/a.go", []byte(`package main
+
+import "testing"
+
+var t testingDetector
+
+var inTest = t.Testing() // want "inTest holds the result"
+
+var ok = t.Testing
+
+func main() {
+	if t.Testing() {
+		println(testing.Short())
+	}
+	if !t.Testing() {
+		println(testing.Short()) // want "testing.Short is only reached"
+	}
+	if t.Testing() {
+		println("test")
+	} else if testing.Verbose() { // want "testing.Verbose is only reached"
+		println("verbose")
+	}
+	if (!t.Testing()) && inTest {
+		println(testing.Short())
+	}
+	println(ok())
+}
+`))
+	writeFile(t, dir, "src/a/a_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(tt *testing.T) {
+	if !t.Testing() {
+		tt.Log(testing.Short())
+	}
+}
+`))
+	analysistest.Run(t, dir, Analyzer, "a")
+}
@@ -0,0 +1,233 @@
+package detect
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+)
+
+// A cacheEntry records the result of scanning a package whose files and
+// generator options hashed to its key.
+type cacheEntry struct {
+	Uses  bool
+	Vars  []string
+	Files []cacheFile
+}
+
+type cacheFile struct {
+	Name string
+	Data []byte
+}
+
+func (e *cacheEntry) files() []file {
+	files := make([]file, len(e.Files))
+	for i, f := range e.Files {
+		files[i] = file{f.Name, f.Data}
+	}
+	return files
+}
+
+// cacheKey hashes everything that goes into scanning pkg: the version of
+// testdetect, or the running executable if that is a local build, the
+// options and toolchain that affect the generated files, and the name and
+// contents of every file in the package other than the detector files
+// themselves.
+func (g *Generator) cacheKey(pkg *packages.Package) (string, error) {
+	goVersion, err := g.goVersion()
+	if err != nil {
+		return "", err
+	}
+	version := Version()
+	if localBuild(version) {
+		// Builds from a local checkout can share a version, so tell them
+		// apart by their contents.
+		sum, err := executableHash()
+		if err != nil {
+			return "", err
+		}
+		version += " " + sum
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "testdetect %s\n", version)
+	opts, err := json.Marshal(struct {
+		Type, Method, Out, TamperMsg           string
+		Subpackage, GoVersion, Toolchain       string
+		TypeParams                             []string
+		Mode                                   Mode
+		Backing                                Backing
+		Tamper                                 Tamper
+		NoTamper, Force, Extend                bool
+		Benchmarking, Fuzzing, Coverage, Short bool
+		Race, RunFilter, CoverExclude, Verbose bool
+		TestName, TestPath, OnTesting          bool
+		Iteration, Sanitizer                   bool
+		ModeMethod, Assert, Stub               bool
+		DirectlyTested, CleanupOnTesting       bool
+		OffTag, OnTestingContext, Guard        bool
+		Expvar                                 bool
+	}{
+		g.Type, g.Method, g.Out, g.TamperMsg, g.Subpackage, goVersion,
+		g.toolchain().name,
+		g.TypeParams, g.Mode, g.Backing, g.Tamper,
+		g.NoTamper, g.Force, g.Extend,
+		g.Benchmarking, g.Fuzzing, g.Coverage, g.Short,
+		g.Race, g.RunFilter, g.CoverExclude, g.Verbose,
+		g.TestName, g.TestPath, g.OnTesting,
+		g.Iteration, g.Sanitizer,
+		g.ModeMethod, g.Assert, g.Stub,
+		g.DirectlyTested, g.CleanupOnTesting,
+		g.OffTag, g.OnTestingContext, g.Guard,
+		g.Expvar,
+	})
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "%s\n%s\n%s\n", opts, pkg.Dir, pkg.Name)
+	base := g.base()
+	if g.CleanupOnTesting || g.OnTestingContext {
+		// Whether to generate TestMain depends on the test files, which
+		// are not hashed.
+		found, err := hasTestMain(pkg.Dir, base+"_test.go")
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "TestMain %t\n", found)
+	}
+	own := []string{
+		base + ".go", base + "_test.go", base + "_testdetect.go",
+		base + "_off.go", base + "_ignore.go",
+	}
+	paths := slices.Concat(pkg.GoFiles, pkg.OtherFiles, pkg.IgnoredFiles)
+	slices.Sort(paths)
+	for _, path := range slices.Compact(paths) {
+		if slices.Contains(own, filepath.Base(path)) {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("could not open %s: %w", path, err)
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %w", path, err)
+		}
+		fmt.Fprintf(h, "%s %x\n", path, fh.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localBuild reports whether version, as returned by [Version], can be
+// shared by builds of different code: a devel build, a pseudo-version such
+// as the go command stamps on builds from a checkout, one marked +dirty for
+// uncommitted changes, or any build that records them with vcs.modified.
+func localBuild(version string) bool {
+	if version == "devel" || module.IsPseudoVersion(version) ||
+		strings.HasSuffix(version, "+dirty") {
+		return true
+	}
+	info, ok := debug.ReadBuildInfo()
+	return ok && slices.Contains(info.Settings,
+		debug.BuildSetting{Key: "vcs.modified", Value: "true"})
+}
+
+// executableHash returns a hash of the contents of the running executable.
+var executableHash = sync.OnceValues(func() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("could not find executable: %w", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open %s: %w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("could not read %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+})
+
+// uncached returns a copy of g that does not use [Generator.CacheDir].
+// Cached packages are not type-checked, so anything that needs the types of
+// the packages it scans, rather than only their generated files, scans with
+// it.
+func (g *Generator) uncached() *Generator {
+	u := *g
+	u.CacheDir = ""
+	return &u
+}
+
+// cached returns the key of pkg in g.CacheDir and its entry, if any. A
+// missing or unreadable entry is a miss. Without a CacheDir, it returns
+// neither.
+func (g *Generator) cached(
+	pkg *packages.Package,
+) (key string, entry *cacheEntry, err error) {
+	if g.CacheDir == "" {
+		return "", nil, nil
+	}
+	if key, err = g.cacheKey(pkg); err != nil {
+		return "", nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(g.CacheDir, key+".json"))
+	if err != nil {
+		return key, nil, nil
+	}
+	entry = new(cacheEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return key, nil, nil
+	}
+	return key, entry, nil
+}
+
+// cache stores the result of scanning the package with key in g.CacheDir.
+func (g *Generator) cache(
+	key string, uses bool, vars []string, files []file,
+) error {
+	if g.CacheDir == "" {
+		return nil
+	}
+	entry := cacheEntry{Uses: uses, Vars: vars}
+	for _, f := range files {
+		entry.Files = append(entry.Files, cacheFile{f.name, f.data})
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(g.CacheDir, 0755); err != nil {
+		return fmt.Errorf("could not create cache: %w", err)
+	}
+	// Write to a temporary file first so that concurrent runs never read
+	// a partial entry.
+	tmp, err := os.CreateTemp(g.CacheDir, key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not write cache: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(g.CacheDir, key+".json"))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write cache: %w", err)
+	}
+	return nil
+}
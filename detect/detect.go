@@ -0,0 +1,2229 @@
+// Package detect generates testingDetector types.
+//
+// It is the library behind the testdetect command. [Generate] produces the
+// same files as running testdetect in a package directory.
+package detect
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"go/build/constraint"
+	"go/format"
+	"go/token"
+	"go/version"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/txtar"
+)
+
+//nolint:lll
+var testingDetector = template.Must(template.New("").Parse(`// Code generated by lesiw.io/testdetect {{.Version}}. DO NOT EDIT.
+{{- with .Constraint}}
+
+//go:build {{.}}
+
+{{- end}}
+package {{.Package}}
+{{- with .Imports}}
+
+import (
+{{- range .}}
+	"{{.}}"
+{{- end}}
+)
+{{- end}}
+{{- if .Tamper}}
+
+var {{.Helper}}CovHack bool
+{{- if .TamperLog}}
+var {{.Helper}}TamperOut io.Writer = os.Stderr
+{{- end}}
+
+func init() { {{.Helper}}Init() }
+func {{.Helper}}Init() {
+	if got, want := (&{{.Inst}}{}).{{.Method}}(), {{.IsTesting}}; {{.Helper}}CovHack || got != want {
+		{{if .TamperLog}}fmt.Fprintln({{.Helper}}TamperOut, {{.TamperPanic}}){{else}}panic({{.TamperPanic}}){{end}}
+	}
+}
+{{- end}}
+
+type {{.TypeDecl}} struct{ {{.Helper}}Override }
+
+// {{.Helper}}Override gets the test binary's implementations.
+type {{.Helper}}Override struct{ {{.Helper}}Embed }
+type {{.Helper}}Embed struct{}
+{{- if .BackingFunc}}
+
+// Test code sets {{.Type}}Backing to decide what {{.Method}} reports.
+var {{.Type}}Backing func() bool
+
+func (t {{.Helper}}Embed) {{.Method}}() bool {
+	if f := {{.Type}}Backing; f != nil {
+		return f()
+	}
+	return {{if .Main}}false{{else}}{{.IsTesting}}{{end}}
+}
+{{- else}}
+
+func (t {{.Helper}}Embed) {{.Method}}() bool { return {{if .Main}}false{{else}}{{.IsTesting}}{{end}} }
+{{- end}}
+{{- if .Benchmarking}}
+func (t {{.Helper}}Embed) Benchmarking() bool { return false }
+{{- end}}
+{{- if .Fuzzing}}
+func (t {{.Helper}}Embed) Fuzzing() bool { return false }
+{{- end}}
+{{- if .Coverage}}
+func (t {{.Helper}}Embed) Coverage() bool { return {{.Helper}}Coverage() }
+{{- end}}
+{{- if .Race}}
+func (t {{.Helper}}Embed) Race() bool { return {{.Helper}}Race() }
+{{- end}}
+{{- if .Sanitizer}}
+func (t {{.Helper}}Embed) Sanitizer() string { return {{.Helper}}Sanitizer() }
+{{- end}}
+{{- if .Short}}
+func (t {{.Helper}}Embed) Short() bool { return false }
+{{- end}}
+{{- if .Verbose}}
+func (t {{.Helper}}Embed) Verbose() bool { return false }
+{{- end}}
+{{- if .DirectlyTested}}
+func (t {{.Helper}}Embed) DirectlyTested() bool { return false }
+{{- end}}
+{{- if .RunFilter}}
+func (t {{.Helper}}Embed) RunFilter() string { return "" }
+{{- end}}
+{{- if .TestName}}
+func (t {{.Helper}}Embed) TestName() string { return "" }
+{{- end}}
+{{- if .TestPath}}
+func (t {{.Helper}}Embed) TestPath() []string { return nil }
+{{- end}}
+{{- if .Iteration}}
+func (t {{.Helper}}Embed) Iteration() int { return 0 }
+{{- end}}
+{{- if .OnTesting}}
+func (t {{.Helper}}Embed) OnTesting(f func({{if .OnTestingContext}}context.Context{{end}})) { {{- if not .Main}}if {{.IsTesting}} { f({{if .OnTestingContext}}context.Background(){{end}}) }{{end}} }
+{{- end}}
+{{- if .CleanupOnTesting}}
+func (t {{.Helper}}Embed) CleanupOnTesting(func()) {}
+{{- end}}
+{{- if .ModeMethod}}
+func (t {{.Helper}}Embed) Mode() {{.Type}}Mode { return {{.Type}}Mode{ {{- if not .Main}}Testing: {{.IsTesting}}{{end}}} }
+{{- end}}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed
+{{- if .Pointer}}
+
+// Declared on the pointer, these are safe to call through a nil
+// *{{.Type}}, and a method declared by hand on {{.Type}} that
+// shadows one fails the build.
+{{- range .Delegates}}
+func ({{$.Recv}}) {{.Name}}({{.Params}}) {{.Results}} { {{if .Results}}return {{end}}{{$.Helper}}Override{}.{{.Name}}({{.Args}}) }
+{{- end}}
+{{- else}}
+
+// A method declared by hand on {{.Type}} that shadows a
+// generated one makes its selector below ambiguous, failing the build.
+type {{.Helper}}Probe struct {
+	{{.Inst}}
+	{{.Helper}}Shadow
+}
+type {{.Helper}}Shadow struct{}
+{{range .Probe}}
+func ({{$.Helper}}Shadow) {{.}}() {}
+{{- end}}
+{{range .Probe}}
+var _ = {{$.Helper}}Probe.{{.}}
+{{- end}}
+{{- end}}
+{{- with .Extended}}
+
+// Extend requires a hand-written {{.}} method.
+var _ func(*{{$.Inst}}) bool = (*{{$.Inst}}).{{.}}
+{{- end}}
+{{- with .Export}}
+
+// {{.}} reports what {{$.Type}}.{{.}} reports.
+func {{.}}() bool { return ({{if $.Pointer}}&{{end}}{{$.Inst}}{}).{{.}}() }
+{{- end}}
+{{- with .Hook}}
+
+// {{.}} makes {{$.Export}} report true outside of the package's own
+// tests. The _test.go file generated beside the importing package sets it.
+var {{.}} bool
+{{- end}}
+{{- if .ModeMethod}}
+
+// {{.Type}}Mode describes the binary that {{.Type}}.Mode is called in.
+// Outside of test binaries, it is the zero value.
+type {{.Type}}Mode struct {
+	Testing      bool // Whether the binary is a test binary.
+	Benchmarking bool // Whether the caller is running inside a benchmark.
+	Fuzzing      bool // Whether the caller is running inside a fuzz target.
+	Coverage     bool // Whether the test binary was built with coverage enabled.
+	Short        bool // Whether the test binary was run with -test.short.
+}
+{{- end}}
+{{- if .Coverage}}
+
+var {{.Helper}}Coverage = sync.OnceValue(func() bool { return coverage.WriteMeta(io.Discard) == nil })
+{{- end}}
+{{- if .TestBinary}}
+
+// {{.Helper}}TestBinary reports whether the binary has a test binary's
+// name, for toolchains without testing.Testing.
+func {{.Helper}}TestBinary() bool {
+	return strings.HasSuffix(os.Args[0], ".test") || strings.HasSuffix(os.Args[0], ".test.exe")
+}
+{{- end}}
+{{- if .Race}}
+
+var {{.Helper}}Race = sync.OnceValue(func() bool {
+	info, ok := debug.ReadBuildInfo()
+	return ok && {{.Helper}}RaceSetting(info.Settings)
+})
+
+func {{.Helper}}RaceSetting(settings []debug.BuildSetting) bool {
+	for _, s := range settings {
+		if s.Key == "-race" {
+			return s.Value == "true"
+		}
+	}
+	return false
+}
+{{- end}}
+{{- if .Sanitizer}}
+
+var {{.Helper}}Sanitizer = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	return {{.Helper}}SanitizerSetting(info.Settings)
+})
+
+func {{.Helper}}SanitizerSetting(settings []debug.BuildSetting) string {
+	for _, s := range settings {
+		switch s.Key {
+		case "-race", "-msan", "-asan":
+			if s.Value == "true" {
+				return s.Key[1:]
+			}
+		}
+	}
+	return ""
+}
+{{- end}}
+`))
+
+//nolint:lll
+var testingDetectorTest = template.Must(template.New("").Parse(`// Code generated by lesiw.io/testdetect {{.Version}}. DO NOT EDIT.
+{{- with .Constraint}}
+
+//go:build {{.}}
+
+{{- end}}
+package {{.Package}}
+{{- with .TestImports}}
+
+import (
+{{- range .}}
+	"{{.}}"
+{{- end}}
+)
+{{- end}}
+{{- if .Expvar}}
+
+// {{.Helper}}Calls counts the calls to {{.Method}}, published with expvar as {{.Type}}.{{.Method}}.
+var {{.Helper}}Calls = expvar.NewInt("{{.Type}}.{{.Method}}")
+
+func (t {{.Helper}}Override) {{.Method}}() bool {
+	{{.Helper}}Calls.Add(1)
+	return true
+}
+{{- else if not .BackingFunc}}
+
+func (t {{.Helper}}Override) {{.Method}}() bool { return true }
+{{- end}}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.{{.Method}}()
+{{- if and .CoverExclude .Export}}
+var _ = {{.Export}}()
+{{- end}}
+{{- if and .BackingFunc .CoverExclude}}
+
+func init() {
+	prev := {{.Type}}Backing
+	{{.Type}}Backing = func() bool { return true }
+	_ = ({{.Inst}}{}).{{.Helper}}Embed.{{.Method}}()
+	{{.Type}}Backing = prev
+}
+{{- end}}
+{{- if .Pointer}}
+
+// Call the methods declared on the pointer, so that they count as covered.
+func init() {
+{{- range .Delegates}}
+{{- if .Results}}
+	_ = (*{{$.Inst}})(nil).{{.Name}}()
+{{- else if $.CoverExclude}}
+	(*{{$.Inst}})(nil).{{.Name}}({{.Noop}})
+{{- end}}
+{{- end}}
+{{- if .Expvar}}
+	{{.Helper}}Calls.Add(-1) // Uncount the call above.
+{{- end}}
+}
+{{- end}}
+{{- if .Benchmarking}}
+
+func (t {{.Helper}}Override) Benchmarking() bool { return {{.Helper}}Caller("testing.(*B).") }
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Benchmarking()
+{{- end}}
+{{- if .Fuzzing}}
+
+func (t {{.Helper}}Override) Fuzzing() bool { return {{.Helper}}Caller("testing.(*F).Fuzz.") }
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Fuzzing()
+{{- end}}
+{{- if .Coverage}}
+
+func (t {{.Helper}}Override) Coverage() bool { return testing.CoverMode() != "" }
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Coverage()
+{{- end}}
+{{- if .Race}}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Race()
+var _ = {{.Helper}}RaceSetting([]debug.BuildSetting{ {Key: "-race"} }) || {{.Helper}}RaceSetting(nil)
+{{- end}}
+{{- if .Sanitizer}}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Sanitizer()
+var _ = {{.Helper}}SanitizerSetting([]debug.BuildSetting{ {Key: "-msan"}, {Key: "-asan", Value: "true"} }) + {{.Helper}}SanitizerSetting(nil)
+{{- end}}
+{{- if .Short}}
+
+func (t {{.Helper}}Override) Short() bool { return flag.Parsed() && testing.Short() }
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Short()
+{{- end}}
+{{- if .Verbose}}
+
+func (t {{.Helper}}Override) Verbose() bool { return flag.Parsed() && testing.Verbose() }
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Verbose()
+{{- end}}
+{{- if .DirectlyTested}}
+
+func (t {{.Helper}}Override) DirectlyTested() bool { return true }
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.DirectlyTested()
+{{- end}}
+{{- if .RunFilter}}
+
+func (t {{.Helper}}Override) RunFilter() string {
+	if !flag.Parsed() {
+		return ""
+	}
+	if f := flag.Lookup("test.run"); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.RunFilter()
+{{- end}}
+{{- if or .TestName .TestPath .Iteration}}
+
+var (
+	{{.Helper}}Mu   sync.Mutex
+	{{.Helper}}Name string
+)
+{{- if .TestName}}
+
+func (t {{.Helper}}Override) TestName() string {
+	{{.Helper}}Mu.Lock()
+	defer {{.Helper}}Mu.Unlock()
+	return {{.Helper}}Name
+}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.TestName()
+{{- end}}
+{{- if .TestPath}}
+
+func (t {{.Helper}}Override) TestPath() []string {
+	{{.Helper}}Mu.Lock()
+	defer {{.Helper}}Mu.Unlock()
+	if {{.Helper}}Name == "" {
+		return nil
+	}
+	return strings.Split({{.Helper}}Name, "/")
+}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.TestPath()
+{{- end}}
+{{- if .Iteration}}
+
+// {{.Helper}}Runs counts the registrations of each test name.
+var {{.Helper}}Runs = make(map[string]int)
+
+func (t {{.Helper}}Override) Iteration() int {
+	{{.Helper}}Mu.Lock()
+	defer {{.Helper}}Mu.Unlock()
+	return {{.Helper}}Runs[{{.Helper}}Name]
+}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Iteration()
+{{- end}}
+
+// {{.Exported}}Register makes tb the test reported by {{if .TestName}}TestName{{else if .TestPath}}TestPath{{else}}Iteration{{end}} until tb finishes.
+func {{.Exported}}Register(tb testing.TB) {
+	{{.Helper}}Mu.Lock()
+	defer {{.Helper}}Mu.Unlock()
+	prev := {{.Helper}}Name
+	{{.Helper}}Name = tb.Name()
+{{- if .Iteration}}
+	{{.Helper}}Runs[{{.Helper}}Name]++
+{{- end}}
+	tb.Cleanup(func() {
+		{{.Helper}}Mu.Lock()
+		defer {{.Helper}}Mu.Unlock()
+		{{.Helper}}Name = prev
+	})
+}
+{{- end}}
+{{- if .OnTesting}}
+
+var (
+	{{.Helper}}OnTestingMu    sync.Mutex
+	{{.Helper}}OnTestingDone  bool
+	{{.Helper}}OnTestingFuncs []func({{if .OnTestingContext}}context.Context{{end}})
+)
+{{- if .OnTestingContext}}
+
+var {{.Helper}}OnTestingCtx, {{.Helper}}OnTestingCancel = context.WithCancel(context.Background())
+{{- end}}
+
+func (t {{.Helper}}Override) OnTesting(f func({{if .OnTestingContext}}context.Context{{end}})) {
+	{{.Helper}}OnTestingMu.Lock()
+	if !{{.Helper}}OnTestingDone {
+		{{.Helper}}OnTestingFuncs = append({{.Helper}}OnTestingFuncs, f)
+		{{.Helper}}OnTestingMu.Unlock()
+		return
+	}
+	{{.Helper}}OnTestingMu.Unlock()
+	f({{if .OnTestingContext}}{{.Helper}}OnTestingCtx{{end}})
+}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.OnTesting
+{{- if and .CoverExclude (not .Main)}}
+
+func init() { ({{.Inst}}{}).{{.Helper}}Embed.OnTesting(func({{if .OnTestingContext}}context.Context{{end}}) {}) }
+{{- end}}
+{{- if .OnTestingContext}}
+
+// {{.Exported}}CancelOnTesting cancels the context passed to the functions registered with OnTesting.
+// A hand-written TestMain must call it once m.Run returns.
+func {{.Exported}}CancelOnTesting() { {{.Helper}}OnTestingCancel() }
+{{- end}}
+
+// Run the functions registered so far; OnTesting runs later ones itself.
+func init() {
+	{{.Helper}}OnTestingMu.Lock()
+	funcs := {{.Helper}}OnTestingFuncs
+	{{.Helper}}OnTestingFuncs, {{.Helper}}OnTestingDone = nil, true
+	{{.Helper}}OnTestingMu.Unlock()
+	for _, f := range funcs {
+		f({{if .OnTestingContext}}{{.Helper}}OnTestingCtx{{end}})
+	}
+}
+{{- end}}
+{{- if .CleanupOnTesting}}
+
+var (
+	{{.Helper}}CleanupMu    sync.Mutex
+	{{.Helper}}CleanupFuncs []func()
+)
+
+func (t {{.Helper}}Override) CleanupOnTesting(f func()) {
+	{{.Helper}}CleanupMu.Lock()
+	defer {{.Helper}}CleanupMu.Unlock()
+	{{.Helper}}CleanupFuncs = append({{.Helper}}CleanupFuncs, f)
+}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.CleanupOnTesting
+
+// {{.Exported}}RunCleanups runs the functions registered with CleanupOnTesting, most recent first.
+// A hand-written TestMain must call it once m.Run returns.
+func {{.Exported}}RunCleanups() {
+	{{.Helper}}CleanupMu.Lock()
+	funcs := {{.Helper}}CleanupFuncs
+	{{.Helper}}CleanupFuncs = nil
+	{{.Helper}}CleanupMu.Unlock()
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i]()
+	}
+}
+{{- end}}
+{{- if .TestMain}}
+
+func TestMain(m *testing.M) {
+	m.Run()
+{{- if .OnTestingContext}}
+	{{.Exported}}CancelOnTesting()
+{{- end}}
+{{- if .CleanupOnTesting}}
+	{{.Exported}}RunCleanups()
+{{- end}}
+}
+{{- end}}
+{{- if .ModeMethod}}
+
+func (t {{.Helper}}Override) Mode() {{.Type}}Mode {
+	return {{.Type}}Mode{
+		Testing:      true,
+		Benchmarking: {{.Helper}}Caller("testing.(*B)."),
+		Fuzzing:      {{.Helper}}Caller("testing.(*F).Fuzz."),
+		Coverage:     testing.CoverMode() != "",
+		Short:        flag.Parsed() && testing.Short(),
+	}
+}
+
+var _ = ({{.Inst}}{}).{{.Helper}}Embed.Mode()
+{{- end}}
+{{- if .Assert}}
+
+// {{.Exported}}Assert fails tb unless {{.Method}} reports true, as it always should
+// in a test binary. If it fails, the generated files are out of sync.
+func {{.Exported}}Assert(tb testing.TB) {
+	tb.Helper()
+	if !(&{{.Inst}}{}).{{.Method}}() {
+		tb.Fatal("{{.Type}}.{{.Method}}() = false in a test binary: regenerate it with testdetect")
+	}
+}
+{{- end}}
+{{- if or .Benchmarking .Fuzzing .ModeMethod}}
+
+func {{.Helper}}Caller(prefix string) bool {
+	pc := make([]uintptr, 64)
+	for skip := 2; ; skip += len(pc) {
+		n := runtime.Callers(skip, pc)
+		frames := runtime.CallersFrames(pc[:n])
+		for {
+			frame, more := frames.Next()
+			if strings.HasPrefix(frame.Function, prefix) {
+				return true
+			}
+			if !more {
+				break
+			}
+		}
+		if n < len(pc) {
+			return false
+		}
+	}
+}
+{{- end}}
+{{- if .Tamper}}
+
+func init() {
+	{{.Helper}}CovHack = true
+{{- if .TamperLog}}
+	out := {{.Helper}}TamperOut
+	{{.Helper}}TamperOut = io.Discard
+	defer func() { {{.Helper}}TamperOut = out }()
+{{- else}}
+	defer func() { recover() }()
+{{- end}}
+	{{.Helper}}Init()
+}
+{{- end}}
+`))
+
+//nolint:lll
+var testingDetectorTag = template.Must(template.New("").Parse(`// Code generated by lesiw.io/testdetect {{.Version}}. DO NOT EDIT.
+
+//go:build {{.Constraint}}
+
+package {{.Package}}
+
+type {{.TypeDecl}} struct{}
+
+func (t {{.Recv}}) {{.Method}}() bool { return {{.Tagged}} }
+{{- with .Export}}
+
+// {{.}} reports what {{$.Type}}.{{.}} reports.
+func {{.}}() bool { return ({{if $.Pointer}}&{{end}}{{$.Inst}}{}).{{.}}() }
+{{- end}}
+{{- if .CoverExclude}}
+
+var _ = ({{if .Pointer}}&{{end}}{{.Inst}}{}).{{.Method}}()
+{{- with .Export}}
+var _ = {{.}}()
+{{- end}}
+{{- end}}
+`))
+
+// A Mode selects how generated code tells test binaries apart from the
+// program binary.
+type Mode string
+
+const (
+	// ModeTest overrides the detector method in a _test.go file, so it
+	// reports true exactly in test binaries. It is the default.
+	ModeTest Mode = "test"
+
+	// ModeBuildTag puts each implementation of the detector method in a file
+	// guarded by the testdetect build tag, so it reports true in any binary
+	// built with -tags testdetect, whether or not it is a test binary.
+	ModeBuildTag Mode = "buildtag"
+)
+
+// OffTag is the build tag under which [Generator.OffTag] makes the detector
+// method report false in test binaries too.
+const OffTag = "testdetect_off"
+
+// IgnoreTag is the build tag that excludes the files generated with
+// [Generator.Guard], other than a stub that stands in for them.
+const IgnoreTag = "testdetect_ignore"
+
+// A Tamper selects what the tamper check does when it fails.
+type Tamper string
+
+const (
+	// TamperPanic panics with the tamper message during initialization. It
+	// is the default.
+	TamperPanic Tamper = "panic"
+
+	// TamperLog writes the tamper message to standard error and lets the
+	// program continue. The detector method still reports what the
+	// tampering code makes it report.
+	TamperLog Tamper = "log"
+)
+
+// A Backing selects what the detector method reports in ModeTest.
+type Backing string
+
+const (
+	// BackingMethod overrides the detector method in the _test.go file, so
+	// that it is constant in main packages. It is the default.
+	BackingMethod Backing = "method"
+
+	// BackingFunc has the detector method call a function variable named
+	// after the type, as in testingDetectorBacking, which test code sets
+	// when it sees fit, such as from TestMain. Until it is set, the method
+	// reports what it would in the program binary. This leaves the timing
+	// to the caller instead of package initialization order, at the cost
+	// of the method no longer being constant, and the tamper check, which
+	// runs during initialization, is left out.
+	BackingFunc Backing = "func"
+)
+
+// header begins every file the generator writes.
+const header = "// Code generated by lesiw.io/testdetect"
+
+// Defaults used for empty [Generator] fields.
+const (
+	DefaultType      = "testingDetector"
+	DefaultMethod    = "Testing"
+	DefaultTamperMsg = "bad {{.Type}} state: got {{.Got}}, want {{.Want}}"
+)
+
+// Generator generates testingDetector source files.
+//
+// The zero value is ready to use.
+type Generator struct {
+	// Type is the name of the generated detector type.
+	// If empty, it defaults to [DefaultType]. An exported name, such as
+	// TestingDetector, lets other packages import the detector from a
+	// library; the declarations the detector needs internally stay
+	// unexported, as in testingDetectorEmbed, so its API is only the type,
+	// its methods, and any Mode struct or Backing variable.
+	Type string
+
+	// Method is the name of the generated detector method.
+	// If empty, it defaults to [DefaultMethod].
+	Method string
+
+	// NoTamper omits the tamper check from main packages, leaving the
+	// program binary with nothing but the constant detector methods.
+	NoTamper bool
+
+	// Extend leaves the detector method to hand-written code and generates
+	// a flag method in its place (named after the type, as in
+	// testingDetectorFlag), which reports what the detector method would.
+	// The hand-written detector method must call the flag method on its
+	// receiver; generation fails if it does not. The generated files also
+	// fail to build without the method, but the type system cannot tell
+	// whether it calls the flag method, so only generation and
+	// [Generator.Check] catch one edited to stop calling it afterwards. In
+	// main packages, the tamper check applies to the flag method instead.
+	Extend bool
+
+	// TamperMsg is a text/template for the message that main packages panic
+	// with when the tamper check fails. {{.Type}} and {{.Method}} expand to
+	// the configured names, and {{.Got}} and {{.Want}} to the observed and
+	// expected results of the detector method.
+	// If empty, it defaults to [DefaultTamperMsg].
+	TamperMsg string
+
+	// Tamper selects what the tamper check does when it fails.
+	// If empty, it defaults to [TamperPanic].
+	Tamper Tamper
+
+	// Out is the base name of the generated files, without the .go
+	// extension. If empty, it is derived from Type, so the default type
+	// produces testing_detector.go and testing_detector_test.go.
+	Out string
+
+	// TypeParams, if not empty, names the type parameters of a generic
+	// detector type, as in testingDetector[T any]. Every parameter is
+	// constrained by any: the detector holds no values of them, so they only
+	// serve to tell instantiations apart.
+	TypeParams []string
+
+	// Package, if not empty, is the name that the package Generate writes
+	// into must have, such as $GOPACKAGE under go generate. The name of an
+	// external test package, with its _test suffix, also matches.
+	Package string
+
+	// Subpackage, if not empty, is the directory, relative to the one
+	// given to Generate or Check, of the package to put the detector in
+	// instead, such as internal/testdetect. The package is created if it
+	// does not exist, named after the directory, and must not be a main
+	// package. Besides the detector type, it gets an exported function
+	// named after the detector method, such as Testing, that the package
+	// in the original directory and others can call. Outside of its own
+	// tests, the function reports an exported variable named after the
+	// type, as in TestingDetectorHook, which a _test.go file generated
+	// into the original directory, testing_detector_hook_test.go for the
+	// default type, sets as its test binary starts. Program binaries thus
+	// never link the testing package, but calls to the function are not
+	// constant, and it reports false in the test binaries of other
+	// packages that import the subpackage, and to package-level variables
+	// initialized before the hook is set. [ModeBuildTag] needs no hook.
+	// Package is ignored when Subpackage is set.
+	Subpackage string
+
+	// Mode selects how the detector method is implemented.
+	// If empty, it defaults to [ModeTest]. [ModeBuildTag] does not support
+	// any of the optional methods below, nor Assert.
+	Mode Mode
+
+	// Backing selects what backs the detector method in [ModeTest]. If
+	// empty, it defaults to [BackingMethod].
+	Backing Backing
+
+	// OffTag generates a third file, testing_detector_off.go for the
+	// default type, that replaces the other two in binaries built with
+	// -tags testdetect_off (see the [OffTag] constant). Its detector method
+	// reports false even in test binaries, so that go test -tags
+	// testdetect_off runs tests against the program's code paths. The
+	// optional methods report what they would in the program binary. It
+	// requires [ModeTest] and [BackingMethod], and does not support Assert,
+	// TestName, TestPath, Iteration, CleanupOnTesting, or OnTestingContext,
+	// whose functions for tests to call are not generated under the tag.
+	OffTag bool
+
+	// Expvar makes the detector method of the _test.go file count its calls
+	// in an expvar.Int published under the type and method names, as in
+	// testingDetector.Testing, for debugging tests through expvar's
+	// /debug/vars handler or expvar.Get. The program binary is unaffected.
+	// It requires [ModeTest] and [BackingMethod].
+	Expvar bool
+
+	// Guard adds !testdetect_ignore (see the [IgnoreTag] constant) to the
+	// build constraints of the generated files. The go command never sets
+	// the tag on its own, so the package builds and tests as usual, but
+	// documentation generators and analyzers that process files out of
+	// context can be given -tags testdetect_ignore to skip the generated
+	// files. The tag leaves out both sides of the tamper check together, so
+	// no generated file refers to a declaration it excludes. In their place,
+	// a fourth file, testing_detector_ignore.go, declares a stub like the
+	// one Stub writes, so the package's own files still type-check.
+	Guard bool
+
+	// GoVersion is the oldest Go version, such as "go1.20", that the
+	// generated code must build with. If empty, it defaults to the version
+	// of the go command, as reported by go env GOVERSION. Before Go 1.21,
+	// which added testing.Testing, the generated code tells test binaries
+	// apart by the name go test gives them, ending in .test, so renaming a
+	// test binary with go test -c -o defeats it. Coverage and Race require
+	// Go 1.21, and the oldest version supported is Go 1.18.
+	GoVersion string
+
+	// Benchmarking generates a Benchmarking method that reports whether the
+	// caller is running inside a benchmark. It is always false in the program
+	// binary and in ordinary tests.
+	Benchmarking bool
+
+	// Fuzzing generates a Fuzzing method that reports whether the caller is
+	// running inside a fuzz target passed to (*testing.F).Fuzz. It is always
+	// false in the program binary and in ordinary tests.
+	Fuzzing bool
+
+	// Coverage generates a Coverage method that reports whether the binary
+	// was built with coverage instrumentation, as by go build -cover or
+	// go test -cover. Program binaries detect this through runtime/coverage,
+	// so unlike the other methods it is not constant in the program binary.
+	// In test binaries, it only reports true once tests have started running.
+	Coverage bool
+
+	// CoverExclude has the generated files run, as test binaries start,
+	// every generated statement that tests would not otherwise reach, so
+	// that generated code reports as fully covered and does not lower the
+	// coverage of the package's own code. The default output is fully
+	// covered without running anything extra, except with BackingFunc,
+	// OnTesting in a library, OnTesting or CleanupOnTesting for a nil
+	// pointer, Subpackage or ModeBuildTag, whose remaining statements can
+	// only be reached by calling them. Under BackingFunc, this briefly
+	// sets the backing function during initialization.
+	CoverExclude bool
+
+	// Race generates a Race method that reports whether the binary was built
+	// with the race detector, as by go build -race or go test -race. It reads
+	// the build settings the go command records in the binary, so like
+	// Coverage it is a runtime check, and it reports the same in program and
+	// test binaries.
+	Race bool
+
+	// Sanitizer generates a Sanitizer method that reports which of the
+	// race detector, memory sanitizer, and address sanitizer the binary was
+	// built with, as "race", "msan", or "asan", or "" for none of them. Like
+	// Race, it reads the build settings that the go command records for
+	// -race, -msan, and -asan, and reports the same in program and test
+	// binaries.
+	Sanitizer bool
+
+	// Short generates a Short method that reports testing.Short() in test
+	// binaries once flags have been parsed. It is always false in the program
+	// binary, which never links the testing package. Like testing.Short, it
+	// races with flag parsing if called from a goroutine started during
+	// package initialization.
+	Short bool
+
+	// Verbose generates a Verbose method that reports testing.Verbose(),
+	// which is true when go test runs with -v, in test binaries once flags
+	// have been parsed. Like Short, it is always false in the program binary.
+	Verbose bool
+
+	// DirectlyTested generates a DirectlyTested method that reports whether
+	// the binary is the test binary of the detector's own package. Unlike
+	// the detector method of a library, it is false in the test binaries of
+	// packages that merely import it, as it is in the program binary. In a
+	// main package, which nothing imports, it reports the same as the
+	// detector method.
+	DirectlyTested bool
+
+	// RunFilter generates a RunFilter method that reports the pattern given
+	// to go test -run, once flags have been parsed. It is empty when no
+	// pattern was given and always empty in the program binary. Like Short,
+	// it races with flag parsing if called during package initialization.
+	RunFilter bool
+
+	// TestName generates a TestName method that reports the name of the
+	// current test, and a Register function (named after the type, as in
+	// TestingDetectorRegister) that tests call with their *testing.T to
+	// become the current test. TestName only reflects the most recent test
+	// that registered itself and has not yet finished. It is always empty in
+	// the program binary.
+	TestName bool
+
+	// TestPath generates a TestPath method that reports the name of the
+	// current test split at each slash, from the top-level test down to the
+	// innermost subtest, as in ["TestFoo" "group" "case1"]. It shares the
+	// Register function of TestName and is nil when no test is registered,
+	// which is always the case in the program binary.
+	TestPath bool
+
+	// Iteration generates an Iteration method that reports how many times
+	// a test with the current test's name has registered itself through
+	// the Register function of TestName, counting from 1, or 0 when no test
+	// is registered. go test -count=n runs each test n times within one
+	// test binary, so the nth run of a test that registers itself sees n;
+	// subtests count on their own. It is always 0 in the program binary.
+	Iteration bool
+
+	// OnTesting generates an OnTesting method that registers a function to run
+	// at startup in test binaries only, such as one installing fakes.
+	// Functions registered while packages initialize run from the init
+	// function of the generated _test.go file. The go command hands the
+	// package's files to the compiler sorted by name, test files last, and
+	// init functions run in that order, so this covers package variables and
+	// the init functions of non-test files; functions registered later, such
+	// as from a test file named after the generated one, run right away. In
+	// the program binary of a main package, OnTesting does nothing, so the
+	// functions passed to it are not linked. In a library, it runs the
+	// function right away if testing.Testing() reports true.
+	OnTesting bool
+
+	// OnTestingContext makes the functions OnTesting registers take a
+	// context.Context, which is cancelled when the package's test binary
+	// shuts down, so that background work they start can stop cleanly. It
+	// also generates a CancelOnTesting function (named after the type, as
+	// in TestingDetectorCancelOnTesting) that cancels it. As for
+	// CleanupOnTesting, the generated _test.go file declares a TestMain
+	// that calls it unless the package's tests declare their own, which
+	// must call it after m.Run. Functions that a library runs outside of
+	// its own tests get a context that is never cancelled. It requires
+	// OnTesting.
+	OnTestingContext bool
+
+	// CleanupOnTesting generates a CleanupOnTesting method that registers a
+	// function to run when the package's test binary shuts down, such as
+	// one tearing down fakes, and a RunCleanups function (named after the
+	// type, as in TestingDetectorRunCleanups) that runs them, most recent
+	// first. Unless the package's tests declare their own TestMain, which
+	// must call RunCleanups after m.Run, the generated _test.go file
+	// declares a TestMain that does. CleanupOnTesting does nothing in the
+	// program binary, nor in the test binaries of importing packages, which
+	// do not include the generated _test.go file.
+	CleanupOnTesting bool
+
+	// ModeMethod generates a Mode method that reports, in a struct type
+	// named after the detector type (as in testingDetectorMode), whether the
+	// binary is a test binary and everything Benchmarking, Fuzzing,
+	// Coverage, and Short would report. The struct is only filled in by the
+	// test-side implementation, so in the program binary it is always the
+	// zero value.
+	ModeMethod bool
+
+	// Assert generates a test helper (named after the type, as in
+	// TestingDetectorAssert) that fails the test calling it if the detector
+	// method does not report true, which catches generated files that have
+	// gotten out of sync. Like the other functions generated for tests to
+	// call, it is exported so that external test packages can call it; being
+	// declared in a _test.go file, it is not visible to importing packages.
+	// In main packages, the tamper check catches this too unless NoTamper
+	// is set.
+	Assert bool
+
+	// Stub writes a bare stand-in for the detector type instead, whose
+	// methods always report false or their zero values, so that the package
+	// builds before the detector is generated. It is meant to be committed
+	// and replaced by generating without Stub. Stub removes the generated
+	// _test.go and _testdetect.go files, which would not build against it.
+	Stub bool
+
+	// CacheDir, if not empty, is a directory in which to remember the
+	// result of scanning each package, keyed by a hash of its files, the
+	// generator options, and the testdetect version. Packages whose entry
+	// is found are not type-checked again.
+	CacheDir string
+
+	// Force lets Generate overwrite files with the generated names that do
+	// not start with the generated header, such as generated files whose
+	// header was removed while editing them by hand. By default, such files
+	// are an error.
+	Force bool
+
+	// SkipInvalid makes the methods that take package patterns, such as
+	// GenerateAll, leave out packages whose source files do not parse,
+	// rather than failing. A single package, as given to Generate, is
+	// never left out.
+	SkipInvalid bool
+
+	// Verify makes Generate and GenerateAll build each package they
+	// generate into, along with its test binary, and fail with the
+	// compiler's output if either does not build. It has no effect on a
+	// dry run.
+	Verify bool
+
+	// Compiler names the compiler that Verify, AssertNoTesting and
+	// [Generator.BuildBinaries] build with: a go, tinygo or gccgo binary, as
+	// for the GOCOMPILER environment variable, which applies when Compiler
+	// is empty. If neither is set, they build with the go command. Under
+	// gccgo, generating code that calls testing.Testing, which gccgo lacks,
+	// is an error.
+	Compiler string
+
+	// AssertNoTesting makes Generate and GenerateAll build each main
+	// package they generate into and fail if the program binary contains
+	// any symbols from the testing package. In ModeTest it requires
+	// NoTamper, since the tamper check calls testing.Testing. Other
+	// packages are not checked, since outside of their own tests their
+	// detector methods call testing.Testing too. With Subpackage, the
+	// package in the original directory is checked instead, if it is a
+	// main package. It has no effect on a dry run. It requires the gc
+	// toolchain, since it lists symbols with go tool nm.
+	AssertNoTesting bool
+
+	// Report, if not nil, accumulates a description of the packages scanned
+	// and the files considered by each call.
+	Report *Report
+
+	// Log, if not nil, receives a line for each step the generator takes:
+	// the packages it loads, the detector declarations it finds, and the
+	// files it reads and writes.
+	Log io.Writer
+
+	// DryRun, if not nil, makes Generate describe the files it would create
+	// or overwrite, along with a unified diff of their contents, instead of
+	// writing them.
+	DryRun io.Writer
+
+	// Emit, if not nil, makes Generate and GenerateAll write the generated
+	// files to it instead of the file system, as a txtar archive (see
+	// [golang.org/x/tools/txtar]) that names each file by its path. Every
+	// file is written, whether or not it changed, and nothing is removed.
+	Emit io.Writer
+
+	// Diff, if not nil, makes Check and CheckAll write a unified diff to it
+	// for each stale file, in the format of diff -u, that updates the file
+	// to what Generate would write. Missing files are diffed against
+	// /dev/null.
+	Diff io.Writer
+}
+
+// Generate writes the detector source files into the package in dir using
+// the zero [Generator].
+func Generate(dir string) error { return new(Generator).Generate(dir) }
+
+// Generate writes the detector source files into the package in dir.
+//
+// In a main package, the detector method is constant: true in the package's
+// test binary and false everywhere else. Other packages are compiled once
+// for every binary that imports them, so outside of their own tests the
+// method falls back to testing.Testing() at run time, and reports true in
+// the test binary of any importing package.
+//
+// The files are named after [Generator.Out], so the default type produces
+// testing_detector.go and testing_detector_test.go, or testing_detector.go
+// and testing_detector_testdetect.go in [ModeBuildTag]. Existing files are
+// only overwritten if the generator wrote them. If the package does not use
+// the detector type, perhaps because its name is misspelled, Generate
+// writes nothing and returns an error wrapping [ErrNoDetector].
+func (g *Generator) Generate(dir string) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	pkg, err := g.target(dir)
+	if err != nil {
+		return err
+	}
+	if g.Subpackage != "" {
+		if g.DryRun == nil && g.Emit == nil {
+			if err := os.MkdirAll(pkg.dir, 0755); err != nil {
+				return err
+			}
+		}
+	} else if name := pkg.Name; g.Package != "" &&
+		g.Package != name && g.Package != name+"_test" {
+		return fmt.Errorf("%s contains package %s, not %s",
+			dir, name, g.Package)
+	} else if !pkg.uses {
+		return withKind(ErrNoDetector, fmt.Errorf("%s does not use %s",
+			dir, cmp.Or(g.Type, DefaultType)))
+	}
+	return g.generate(pkg)
+}
+
+// target returns the package that Generate and Check work on for dir: the
+// package in dir itself, or the one g.Subpackage names, whose files then
+// include the one that sets its hook from the tests of the package in dir.
+func (g *Generator) target(dir string) (scannedPackage, error) {
+	if g.Subpackage == "" {
+		return g.scanOne(dir)
+	}
+	pkg, err := g.subpackage(dir)
+	if err != nil {
+		return scannedPackage{}, err
+	}
+	if pkg.caller, err = caller(dir); err != nil {
+		return scannedPackage{}, err
+	}
+	f, ok, err := g.renderHook(dir, pkg.caller)
+	if err != nil {
+		return scannedPackage{}, err
+	} else if ok {
+		pkg.files = append(slices.Clip(pkg.files), f)
+	}
+	return pkg, nil
+}
+
+// subpackage returns the package that g.Subpackage names in dir. One
+// without Go files yet is rendered from scratch.
+func (g *Generator) subpackage(dir string) (scannedPackage, error) {
+	sub := filepath.Join(dir, g.Subpackage)
+	entries, err := os.ReadDir(sub)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return scannedPackage{}, fmt.Errorf("could not read %s: %w", sub, err)
+	}
+	if slices.ContainsFunc(entries, func(e fs.DirEntry) bool {
+		return !e.IsDir() && filepath.Ext(e.Name()) == ".go"
+	}) {
+		pkg, err := g.scanOne(sub)
+		if err != nil {
+			return scannedPackage{}, err
+		} else if pkg.Name == "main" {
+			return scannedPackage{}, fmt.Errorf(
+				"%s is a main package, which cannot be imported", sub)
+		}
+		return pkg, nil
+	}
+	name := filepath.Base(sub)
+	if err := checkIdent("package", name); err != nil {
+		return scannedPackage{}, err
+	}
+	pkg := &packages.Package{Name: name, Dir: sub}
+	files, err := g.render(pkg)
+	if err != nil {
+		return scannedPackage{}, err
+	}
+	return scannedPackage{Package: pkg, dir: sub, uses: true, files: files},
+		nil
+}
+
+// A Summary describes the packages visited by [Generator.GenerateAll].
+type Summary struct {
+	// Generated lists the directories of packages that use the detector.
+	Generated []string
+
+	// Skipped lists the directories of packages that do not.
+	Skipped []string
+
+	// Invalid lists the errors, wrapping [ErrSyntax], of the packages left
+	// out with [Generator.SkipInvalid] because they do not parse.
+	Invalid []error
+}
+
+// GenerateAll writes the detector source files into every package matching
+// patterns that uses the detector type. Patterns are interpreted relative to
+// dir, as by go list, and packages that never mention the detector type are
+// skipped. Like go list, patterns such as ./... do not descend into nested
+// modules, testdata directories, or directories whose names begin with _
+// or a period.
+//
+// Packages are generated into concurrently, up to GOMAXPROCS at a time. If
+// any fail, the returned error joins their errors in package order, and
+// sum.Generated lists the packages that succeeded.
+func (g *Generator) GenerateAll(
+	dir string, patterns ...string,
+) (sum Summary, err error) {
+	if err := g.validate(); err != nil {
+		return sum, err
+	} else if g.Subpackage != "" {
+		return sum, errors.New("GenerateAll does not support Subpackage")
+	}
+	pkgs, invalid, err := g.scanValid(dir, patterns...)
+	if err != nil {
+		return sum, err
+	}
+	sum.Invalid = invalid
+	errs := make([]error, len(pkgs))
+	var eg errgroup.Group
+	eg.SetLimit(runtime.GOMAXPROCS(0))
+	for i, pkg := range pkgs {
+		if !pkg.uses {
+			continue
+		}
+		eg.Go(func() error {
+			errs[i] = g.generate(pkg)
+			return nil
+		})
+	}
+	eg.Wait()
+	for i, pkg := range pkgs {
+		switch {
+		case !pkg.uses:
+			sum.Skipped = append(sum.Skipped, pkg.dir)
+		case errs[i] == nil:
+			sum.Generated = append(sum.Generated, pkg.dir)
+		}
+	}
+	return sum, errors.Join(errs...)
+}
+
+func (g *Generator) generate(pkg scannedPackage) error {
+	dir := pkg.dir
+	for _, f := range pkg.files {
+		if err := g.write(filepath.Join(dir, f.name), f.data); err != nil {
+			return err
+		}
+	}
+	if g.Stub {
+		if err := g.removeStubbed(dir); err != nil {
+			return err
+		}
+	}
+	if g.DryRun != nil || g.Emit != nil {
+		return nil
+	}
+	if g.Verify {
+		if err := g.verify(dir, pkg.Name == "main"); err != nil {
+			return err
+		}
+	}
+	if g.AssertNoTesting && pkg.Name == "main" {
+		return g.assertNoTesting(dir)
+	}
+	if g.AssertNoTesting && pkg.caller != nil && pkg.caller.Name == "main" {
+		return g.assertNoTesting(pkg.caller.Dir)
+	}
+	return nil
+}
+
+// removeStubbed removes the generated files in dir that a stub leaves no
+// place for.
+func (g *Generator) removeStubbed(dir string) error {
+	base := g.base()
+	for _, name := range []string{
+		base + "_test.go",
+		base + "_testdetect.go",
+		base + "_off.go",
+	} {
+		path := filepath.Join(dir, name)
+		if data, err := g.readGenerated(path); err != nil {
+			return err
+		} else if data != nil {
+			if err := g.remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// write and remove are the only places the generator modifies the file
+// system, so that a dry run reports exactly what a real run would do. write
+// refuses to overwrite files that the generator did not write unless
+// g.Force is set.
+func (g *Generator) write(path string, data []byte) error {
+	if g.Emit != nil {
+		g.logf("emit %s", path)
+		ar := &txtar.Archive{Files: []txtar.File{{Name: path, Data: data}}}
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		_, err := g.Emit.Write(txtar.Format(ar))
+		return err
+	}
+	old, err := g.readGenerated(path)
+	if err != nil {
+		return err
+	}
+	g.logf("read %s", path)
+	if old != nil {
+		old = lf(old)
+	}
+	if bytes.Equal(old, data) {
+		g.logf("unchanged %s", path)
+		g.reportFile(path, "unchanged", false)
+		return nil // Leave the modification time alone.
+	}
+	verb, oldName := "overwrite", path
+	if old == nil {
+		verb, oldName = "create", os.DevNull
+	} else if v := headerVersion(old); v != Version() {
+		g.logf("migrate %s from %s", path, v)
+	}
+	g.reportFile(path, verb, g.DryRun == nil)
+	if g.DryRun == nil {
+		g.logf("%s %s", verb, path)
+		if err := replaceFile(path, data); err != nil {
+			return fmt.Errorf("could not write %s: %w", path, err)
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", verb, path)
+	buf.Write(unifiedDiff(oldName, path, old, data))
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err = g.DryRun.Write(buf.Bytes())
+	return err
+}
+
+// replaceFile writes data to a temporary file beside path and renames it into
+// place, so that an interrupted or failed write leaves the old file, or no
+// file, rather than a truncated one. An existing file keeps its permissions.
+func replaceFile(path string, data []byte) error {
+	perm := fs.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	dir, name := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = writeTemp(tmp, data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeTemp writes data to f. Tests replace it to fail partway through.
+var writeTemp = func(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+// readGenerated returns the contents of the generated file at path, or nil
+// if it does not exist. It returns an error if a file at path exists but
+// does not start with the generated header, unless g.Force is set.
+func (g *Generator) readGenerated(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	} else if !g.Force && !bytes.HasPrefix(data, []byte(header)) {
+		return nil, withKind(ErrConflict, fmt.Errorf("could not write %s: "+
+			"file exists and was not generated by testdetect", path))
+	}
+	return data, nil
+}
+
+// headerVersion returns the testdetect version named in the generated
+// header that begins data. Files written before headers carried a version
+// start with the bare header, and are reported as "unversioned". Every
+// version has used the same header prefix, so its files are always replaced
+// without a conflict.
+func headerVersion(data []byte) string {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	line = bytes.TrimPrefix(line, []byte(header))
+	v, _, _ := bytes.Cut(bytes.TrimSpace(line), []byte(" "))
+	if v = bytes.TrimSuffix(v, []byte(".")); len(v) == 0 {
+		return "unversioned"
+	}
+	return string(v)
+}
+
+// lf returns data with CRLF line endings replaced by LF. Generated files
+// are always written with LF endings, as gofmt formats them, but a checkout
+// that converts line endings, such as Git's core.autocrlf on Windows, may
+// turn them into CRLF. Files that differ only in that respect are treated as
+// unchanged.
+func lf(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+// Check reports the paths of the detector source files in dir that are
+// missing or differ from what [Generator.Generate] would write. It does not
+// modify anything.
+func (g *Generator) Check(dir string) (stale []string, err error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	pkg, err := g.target(dir)
+	if err != nil {
+		return nil, err
+	}
+	return g.check(pkg)
+}
+
+// CheckAll is like [Generator.Check] for every package matching patterns
+// that [Generator.GenerateAll] would generate into.
+func (g *Generator) CheckAll(
+	dir string, patterns ...string,
+) (stale []string, err error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	} else if g.Subpackage != "" {
+		return nil, errors.New("CheckAll does not support Subpackage")
+	}
+	pkgs, err := g.scan(dir, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range pkgs {
+		if !pkg.uses {
+			continue
+		}
+		paths, err := g.check(pkg)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, paths...)
+	}
+	return stale, nil
+}
+
+func (g *Generator) check(pkg scannedPackage) (stale []string, err error) {
+	for _, f := range pkg.files {
+		path := filepath.Join(pkg.dir, f.name)
+		g.logf("read %s", path)
+		data, err := os.ReadFile(path)
+		oldName := path
+		if errors.Is(err, fs.ErrNotExist) {
+			oldName = os.DevNull
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", f.name, err)
+		}
+		if data = lf(data); bytes.Equal(data, f.data) {
+			continue
+		}
+		stale = append(stale, path)
+		g.reportFile(path, "stale", false)
+		if g.Diff != nil {
+			diff := unifiedDiff(oldName, path, data, f.data)
+			if _, err := g.Diff.Write(diff); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stale, nil
+}
+
+// Clean removes every file in dir that the generator wrote, whatever its
+// type and options, and returns their paths. Hand-written files are left
+// alone.
+func (g *Generator) Clean(dir string) (removed []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", dir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".go" {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			return removed, fmt.Errorf("could not open %s: %w", path, err)
+		}
+		buf := make([]byte, len(header))
+		_, err = io.ReadFull(f, buf)
+		f.Close()
+		if err != nil || string(buf) != header {
+			continue
+		}
+		if err := g.remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// CleanAll is like [Generator.Clean] for every package matching patterns.
+func (g *Generator) CleanAll(
+	dir string, patterns ...string,
+) (removed []string, err error) {
+	pkgs, err := loadPackages(dir, nil, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range pkgs {
+		rel, err := filepath.Rel(abs, pkg.Dir)
+		if err != nil {
+			return removed, err
+		}
+		paths, err := g.Clean(filepath.Join(dir, rel))
+		removed = append(removed, paths...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// remove deletes the generated file at path, or describes doing so in a dry
+// run. It leaves the file alone when the files are emitted instead.
+func (g *Generator) remove(path string) error {
+	if g.Emit != nil {
+		return nil
+	}
+	g.reportFile(path, "remove", g.DryRun == nil)
+	if g.DryRun != nil {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		_, err := fmt.Fprintf(g.DryRun, "remove %s\n", path)
+		return err
+	}
+	g.logf("remove %s", path)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("could not remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// outputMu serializes writes to a Generator's Log, DryRun, and Report, which
+// packages being generated concurrently share.
+var outputMu sync.Mutex
+
+// logf writes a line to g.Log, if set.
+func (g *Generator) logf(format string, args ...any) {
+	if g.Log != nil {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		fmt.Fprintf(g.Log, format+"\n", args...)
+	}
+}
+
+// A file is a generated source file.
+type file struct {
+	name string
+	data []byte
+}
+
+// validate reports whether g's options can be generated. The errors it
+// returns for options that cannot wrap [ErrOption].
+func (g *Generator) validate() error {
+	for _, check := range []func() error{
+		g.validateKinds, g.validateNames, g.validateTypeParams,
+		g.validateConflicts, g.validatePaths,
+	} {
+		if err := check(); err != nil {
+			return withKind(ErrOption, err)
+		}
+	}
+	return g.validateVersion()
+}
+
+// validateKinds reports whether g's mode, backing and tamper action are
+// known.
+func (g *Generator) validateKinds() error {
+	switch mode := cmp.Or(g.Mode, ModeTest); mode {
+	case ModeTest, ModeBuildTag:
+	default:
+		return fmt.Errorf("bad mode %q", mode)
+	}
+	switch backing := cmp.Or(g.Backing, BackingMethod); backing {
+	case BackingMethod, BackingFunc:
+	default:
+		return fmt.Errorf("bad backing %q", backing)
+	}
+	switch tamper := cmp.Or(g.Tamper, TamperPanic); tamper {
+	case TamperPanic, TamperLog:
+	default:
+		return fmt.Errorf("bad tamper action %q", tamper)
+	}
+	return nil
+}
+
+// validateVersion reports whether the generated code can target the Go
+// version that g does. Unlike the other options, the version may come from
+// running the go command, which can fail without g being at fault.
+func (g *Generator) validateVersion() error {
+	v, err := g.goVersion()
+	if err != nil && g.GoVersion == "" {
+		return err
+	} else if err != nil {
+		return withKind(ErrOption, err)
+	} else if version.Compare(v, "go1.18") < 0 {
+		return withKind(ErrOption, fmt.Errorf(
+			"bad Go version %q: Go 1.18 or later required", v))
+	} else if version.Compare(v, "go1.21") >= 0 {
+		return nil
+	}
+	for _, name := range []string{"Coverage", "Race", "Sanitizer"} {
+		if slices.Contains(g.methods(), name) {
+			return withKind(ErrOption, fmt.Errorf(
+				"%s() requires Go 1.21, not %s", name, v))
+		}
+	}
+	return nil
+}
+
+// validateNames reports whether g's type and method names can be
+// generated.
+func (g *Generator) validateNames() error {
+	typ := cmp.Or(g.Type, DefaultType)
+	if err := checkIdent("type", typ); err != nil {
+		return err
+	}
+	method := cmp.Or(g.Method, DefaultMethod)
+	if err := checkIdent("method", method); err != nil {
+		return err
+	} else if method == unexported(typ)+"Override" ||
+		method == unexported(typ)+"Embed" {
+		return fmt.Errorf("bad method name %q: conflicts with embedded %s",
+			method, method)
+	} else if slices.Contains(g.methods(), method) {
+		return fmt.Errorf("bad method name %q: conflicts with %s()",
+			method, method)
+	} else if g.Subpackage != "" && !token.IsExported(method) {
+		return fmt.Errorf("bad method name %q: Subpackage requires an "+
+			"exported method", method)
+	} else if g.Extend && method == typ+"Flag" {
+		return fmt.Errorf("bad method name %q: conflicts with the flag "+
+			"method of Extend", method)
+	}
+	_, err := g.tamperPanic(typ, method)
+	return err
+}
+
+// validateTypeParams reports whether g's type parameter names can be
+// generated.
+func (g *Generator) validateTypeParams() error {
+	typ := cmp.Or(g.Type, DefaultType)
+	for i, param := range g.TypeParams {
+		if err := checkIdent("type parameter", param); err != nil {
+			return err
+		} else if slices.Contains(g.TypeParams[:i], param) {
+			return fmt.Errorf("bad type parameter name %q: duplicate",
+				param)
+		} else if param == typ || param == "any" {
+			return fmt.Errorf("bad type parameter name %q: shadows %s",
+				param, param)
+		}
+	}
+	return nil
+}
+
+// A conflict is a combination of options that cannot be generated
+// together: when all of options hold, validation fails with err.
+type conflict struct {
+	options []bool
+	err     error
+}
+
+// conflicts returns the combinations of options that g must not set, in
+// the order they are checked.
+func (g *Generator) conflicts() []conflict {
+	mode := cmp.Or(g.Mode, ModeTest)
+	tagged := mode == ModeBuildTag
+	funcBacked := g.Backing == BackingFunc
+	optional := cmp.Or(g.methods()...)
+	tc := g.toolchain().name
+	perTest := slices.Contains([]bool{g.TestName, g.TestPath, g.Iteration},
+		true)
+	return []conflict{
+		{[]bool{tagged, optional != ""}, fmt.Errorf(
+			"mode %q does not support %s()", mode, optional)},
+		{[]bool{tagged, g.Assert}, fmt.Errorf(
+			"mode %q does not support Assert", mode)},
+		{[]bool{tagged, funcBacked}, fmt.Errorf(
+			"mode %q does not support backing %q", mode, g.Backing)},
+		{[]bool{g.OffTag, tagged}, fmt.Errorf(
+			"mode %q does not support OffTag", mode)},
+		{[]bool{g.OffTag, funcBacked}, fmt.Errorf(
+			"backing %q does not support OffTag", g.Backing)},
+		{[]bool{g.OffTag, g.Assert}, errors.New(
+			"OffTag does not support Assert")},
+		{[]bool{g.OffTag, perTest}, errors.New(
+			"OffTag does not support TestName, TestPath, or Iteration")},
+		{[]bool{g.OffTag, g.CleanupOnTesting}, errors.New(
+			"OffTag does not support CleanupOnTesting")},
+		{[]bool{g.OffTag, g.OnTestingContext}, errors.New(
+			"OffTag does not support OnTestingContext")},
+		{[]bool{g.Expvar, tagged}, fmt.Errorf(
+			"mode %q does not support Expvar", mode)},
+		{[]bool{g.Expvar, funcBacked}, fmt.Errorf(
+			"backing %q does not support Expvar", g.Backing)},
+		{[]bool{g.OnTestingContext, !g.OnTesting}, errors.New(
+			"OnTestingContext requires OnTesting")},
+		{[]bool{g.AssertNoTesting, !g.NoTamper, !tagged}, errors.New(
+			"AssertNoTesting requires NoTamper: " +
+				"the tamper check links the testing package")},
+		{[]bool{g.AssertNoTesting, tc != "go"}, fmt.Errorf(
+			"AssertNoTesting does not support %s: "+
+				"it lists symbols with go tool nm", tc)},
+	}
+}
+
+// validateConflicts reports the first combination of options that g sets
+// but cannot generate.
+func (g *Generator) validateConflicts() error {
+	for _, c := range g.conflicts() {
+		if !slices.Contains(c.options, false) {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// validatePaths reports whether g's subpackage and output names are
+// usable.
+func (g *Generator) validatePaths() error {
+	if sub := g.Subpackage; sub != "" && !filepath.IsLocal(sub) {
+		return fmt.Errorf("bad subpackage %q: not a local path", sub)
+	}
+	switch out := g.Out; {
+	case out == "":
+	case strings.ContainsAny(out, `/\`):
+		return fmt.Errorf("bad output name %q: contains a path separator",
+			out)
+	case strings.HasPrefix(out, ".") || strings.HasPrefix(out, "_"):
+		return fmt.Errorf("bad output name %q: ignored by the go command",
+			out)
+	case strings.HasSuffix(out, "_test"):
+		return fmt.Errorf("bad output name %q: ends in _test", out)
+	case strings.HasSuffix(out, ".go"):
+		return fmt.Errorf("bad output name %q: includes .go extension",
+			out)
+	}
+	return nil
+}
+
+// tamperPanic returns the Go expression that the tamper check panics with,
+// in terms of the got and want variables of the generated code.
+func (g *Generator) tamperPanic(typ, method string) (string, error) {
+	msg := cmp.Or(g.TamperMsg, DefaultTamperMsg)
+	// The template expands to a format string, so literal percent signs
+	// must be escaped first.
+	tmpl, err := template.New("").Parse(strings.ReplaceAll(msg, "%", "%%"))
+	if err != nil {
+		return "", fmt.Errorf("bad tamper message %q: %w", msg, err)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, struct{ Type, Method, Got, Want string }{
+		typ, method, "%[1]t", "%[2]t",
+	}); err != nil {
+		return "", fmt.Errorf("bad tamper message %q: %w", msg, err)
+	}
+	format := buf.String()
+	if !strings.Contains(format, "%[1]t") &&
+		!strings.Contains(format, "%[2]t") {
+		// Sprintf would complain about the unused arguments.
+		return fmt.Sprintf("fmt.Sprint(%q)", format), nil
+	}
+	return fmt.Sprintf("fmt.Sprintf(%q, got, want)", format), nil
+}
+
+// base returns the base name of the generated files.
+func (g *Generator) base() string {
+	if g.Out != "" {
+		return g.Out
+	}
+	return snakeCase(cmp.Or(g.Type, DefaultType))
+}
+
+func (g *Generator) render(pkg *packages.Package) ([]file, error) {
+	typ := cmp.Or(g.Type, DefaultType)
+	base := g.base()
+	expr, err := buildConstraint(pkg, typ, base)
+	if err != nil {
+		return nil, err
+	}
+	if g.Stub {
+		stub, err := g.renderStub(pkg, g.variantConstraint(expr, false))
+		if err != nil {
+			return nil, err
+		}
+		return g.withIgnoreStub(pkg, expr, []file{{base + ".go", stub}})
+	}
+	data, err := g.tmplData(pkg)
+	if err != nil {
+		return nil, err
+	}
+	hook, err := g.hook(pkg, &data)
+	if err != nil {
+		return nil, err
+	}
+	g.imports(&data)
+	if g.CleanupOnTesting || g.OnTestingContext {
+		found, err := hasTestMain(pkg.Dir, base+"_test.go")
+		if err != nil {
+			return nil, err
+		}
+		data.TestMain = !found
+		if data.TestMain {
+			data.TestImports = append(data.TestImports, "testing")
+		}
+	}
+	// The imports of the generated files come only from the options, in a
+	// single sorted block, so how the package's own files group theirs
+	// makes no difference.
+	slices.Sort(data.Imports)
+	data.Imports = slices.Compact(data.Imports)
+	slices.Sort(data.TestImports)
+	data.TestImports = slices.Compact(data.TestImports)
+	var files []file
+	for _, v := range g.variants(data, hook) {
+		data := v.data
+		data.Tagged = v.tagged
+		data.Constraint = ""
+		if c := g.variantConstraint(expr, v.tagged); c != nil {
+			data.Constraint = c.String()
+		}
+		var buf bytes.Buffer
+		if err := v.tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("could not generate %s: %w", v.name, err)
+		}
+		src, err := format.Source(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("could not format %s: %w", v.name, err)
+		}
+		files = append(files, file{v.name, src})
+	}
+	return g.withIgnoreStub(pkg, expr, files)
+}
+
+// tmplData returns the data that the templates generate pkg's files from,
+// other than their imports and build constraints.
+func (g *Generator) tmplData(pkg *packages.Package) (tmplData, error) {
+	typ := cmp.Or(g.Type, DefaultType)
+	method := g.implMethod()
+	tamper, err := g.tamperPanic(typ, method)
+	if err != nil {
+		return tmplData{}, err
+	}
+	decl, recv, inst := g.typeExprs()
+	pointer, err := declaresPointer(pkg, typ, g.base())
+	if err != nil {
+		return tmplData{}, err
+	}
+	backingFunc := g.Backing == BackingFunc
+	data := tmplData{
+		Package:     pkg.Name,
+		Type:        typ,
+		Helper:      unexported(typ),
+		Exported:    exported(typ),
+		Probe:       append([]string{method}, g.methods()...),
+		TypeDecl:    decl,
+		Recv:        recv,
+		Inst:        inst,
+		Method:      method,
+		Main:        pkg.Name == "main",
+		BackingFunc: backingFunc,
+		Tamper:      pkg.Name == "main" && !g.NoTamper && !backingFunc,
+		TamperPanic: tamper,
+		TamperLog:   g.Tamper == TamperLog,
+		IsTesting:   "testing.Testing()",
+		Version:     Version(),
+
+		Benchmarking: g.Benchmarking,
+		Fuzzing:      g.Fuzzing,
+		Coverage:     g.Coverage,
+		Race:         g.Race,
+		Sanitizer:    g.Sanitizer,
+		CoverExclude: g.CoverExclude,
+		Short:        g.Short,
+		Verbose:      g.Verbose,
+		RunFilter:    g.RunFilter,
+		TestName:     g.TestName,
+		TestPath:     g.TestPath,
+		Iteration:    g.Iteration,
+		OnTesting:    g.OnTesting,
+		ModeMethod:   g.ModeMethod,
+		Assert:       g.Assert,
+
+		DirectlyTested:   g.DirectlyTested,
+		CleanupOnTesting: g.CleanupOnTesting,
+		OnTestingContext: g.OnTestingContext,
+		Expvar:           g.Expvar,
+	}
+	if g.Subpackage != "" {
+		data.Export = cmp.Or(g.Method, DefaultMethod)
+		if g.Mode != ModeBuildTag {
+			data.Hook = data.Exported + "Hook"
+		}
+	}
+	if g.Extend {
+		data.Extended = cmp.Or(g.Method, DefaultMethod)
+	}
+	if pointer {
+		data.Pointer = true
+		data.Recv = "*" + recv
+		data.Delegates = g.delegates(typ)
+	}
+	return data, nil
+}
+
+// hook picks the package that the generated code in pkg asks whether it
+// is in a test binary, which is testing unless the code must build with Go
+// releases that lack testing.Testing, and adds it to the imports of data.
+func (g *Generator) hook(
+	pkg *packages.Package, data *tmplData,
+) (string, error) {
+	if data.Hook != "" {
+		// The tests of the importing package set the hook instead, so
+		// that program binaries do not link either.
+		data.IsTesting = data.Hook
+		return "", nil
+	}
+	goVersion, err := g.goVersion()
+	if err != nil {
+		return "", err
+	}
+	hook := "testing"
+	if version.Compare(goVersion, "go1.21") < 0 {
+		data.IsTesting = data.Helper + "TestBinary()"
+		data.TestBinary = data.Tamper || !data.Main
+		hook = "os"
+		if data.TestBinary {
+			data.Imports = append(data.Imports, "strings")
+		}
+	}
+	if hook == "testing" && (data.Tamper || !data.Main) &&
+		g.toolchain().name == "gccgo" {
+		return "", fmt.Errorf("%s: gccgo has no testing.Testing, which "+
+			"the tamper check and library detectors call; set NoTamper and "+
+			"keep the detector in main packages, or set GoVersion below "+
+			"go1.21 to check the binary's name instead", pkg.Dir)
+	}
+	if data.Tamper {
+		data.Imports = append(data.Imports, "fmt", hook)
+		if data.TamperLog {
+			data.Imports = append(data.Imports, "io", "os")
+			data.TestImports = append(data.TestImports, "io")
+		}
+	} else if !data.Main {
+		data.Imports = append(data.Imports, hook)
+	}
+	return hook, nil
+}
+
+// imports adds the packages that g's optional methods use to the imports
+// of data.
+func (g *Generator) imports(data *tmplData) {
+	for _, opt := range []struct {
+		on                   bool
+		imports, testImports []string
+	}{
+		{g.Coverage, []string{"io", "runtime/coverage", "sync"},
+			[]string{"testing"}},
+		{g.Race, []string{"runtime/debug", "sync"},
+			[]string{"runtime/debug"}},
+		{g.Sanitizer, []string{"runtime/debug", "sync"},
+			[]string{"runtime/debug"}},
+		{g.Short, nil, []string{"flag", "testing"}},
+		{g.Verbose, nil, []string{"flag", "testing"}},
+		{g.RunFilter, nil, []string{"flag"}},
+		{g.TestName, nil, []string{"sync", "testing"}},
+		{g.TestPath, nil, []string{"strings", "sync", "testing"}},
+		{g.Iteration, nil, []string{"sync", "testing"}},
+		{g.OnTesting, nil, []string{"sync"}},
+		{g.OnTestingContext, []string{"context"}, []string{"context"}},
+		{g.CleanupOnTesting, nil, []string{"sync"}},
+		{g.Assert, nil, []string{"testing"}},
+		{g.Expvar, nil, []string{"expvar"}},
+		{g.Benchmarking, nil, []string{"runtime", "strings"}},
+		{g.Fuzzing, nil, []string{"runtime", "strings"}},
+		{g.ModeMethod, nil,
+			[]string{"flag", "runtime", "strings", "testing"}},
+	} {
+		if opt.on {
+			data.Imports = append(data.Imports, opt.imports...)
+			data.TestImports = append(data.TestImports, opt.testImports...)
+		}
+	}
+}
+
+// A variant is one of the files generated from the same data.
+type variant struct {
+	name   string
+	tmpl   *template.Template
+	tagged bool
+	data   tmplData
+}
+
+// variants returns the files that g generates from data, whose code asks
+// hook whether it is in a test binary.
+func (g *Generator) variants(data tmplData, hook string) []variant {
+	base := g.base()
+	if g.Mode == ModeBuildTag {
+		return []variant{
+			{base + ".go", testingDetectorTag, false, data},
+			{base + "_testdetect.go", testingDetectorTag, true, data},
+		}
+	}
+	variants := []variant{
+		{base + ".go", testingDetector, false, data},
+		{base + "_test.go", testingDetectorTest, false, data},
+	}
+	if g.OffTag {
+		// A test binary built with the tag gets the program binary's
+		// implementation, and nothing that knows otherwise.
+		off := data
+		off.Main = true
+		off.Tamper = false
+		off.TestBinary = false
+		off.Imports = slices.DeleteFunc(slices.Clone(data.Imports),
+			func(path string) bool {
+				return path == "fmt" || path == hook || path == "strings"
+			})
+		variants = append(variants,
+			variant{base + "_off.go", testingDetector, true, off})
+	}
+	return variants
+}
+
+// withIgnoreStub returns files along with, under Guard, a stub for builds
+// with IgnoreTag, which exclude every other generated file. Without it, the
+// package's own files would refer to an undefined type under the tag.
+func (g *Generator) withIgnoreStub(
+	pkg *packages.Package, expr constraint.Expr, files []file,
+) ([]file, error) {
+	if !g.Guard {
+		return files, nil
+	}
+	stub, err := g.renderStub(pkg,
+		andConstraint(expr, &constraint.TagExpr{Tag: IgnoreTag}))
+	if err != nil {
+		return nil, err
+	}
+	return append(files, file{g.base() + "_ignore.go", stub}), nil
+}
+
+// variantConstraint returns the build constraint for a generated file,
+// given the constraint expr shared by the files that use the detector. The
+// tagged file of ModeBuildTag or OffTag requires the tag, and the others
+// exclude it. With Guard, every file excludes IgnoreTag as well.
+func (g *Generator) variantConstraint(
+	expr constraint.Expr, tagged bool,
+) constraint.Expr {
+	var name string
+	switch {
+	case g.Mode == ModeBuildTag:
+		name = "testdetect"
+	case g.OffTag:
+		name = OffTag
+	}
+	if name != "" {
+		var tag constraint.Expr = &constraint.TagExpr{Tag: name}
+		if !tagged {
+			tag = &constraint.NotExpr{X: tag}
+		}
+		expr = andConstraint(expr, tag)
+	}
+	if g.Guard {
+		expr = andConstraint(expr, &constraint.NotExpr{
+			X: &constraint.TagExpr{Tag: IgnoreTag},
+		})
+	}
+	return expr
+}
+
+// andConstraint returns x && y, or y alone if x is nil.
+func andConstraint(x, y constraint.Expr) constraint.Expr {
+	if x == nil {
+		return y
+	}
+	return &constraint.AndExpr{X: x, Y: y}
+}
+
+type tmplData struct {
+	Version    string
+	Package    string
+	Type       string
+	Helper     string // Prefix of generated names outside the API.
+	Exported   string // Prefix of generated names for tests to call.
+	TypeDecl   string // Type with its type parameter list.
+	Recv       string // Type as a method receiver.
+	Inst       string // Type instantiated, for composite literals.
+	Method     string
+	Main       bool
+	Tagged     bool
+	Constraint string
+
+	BackingFunc bool
+
+	Tamper      bool
+	TamperPanic string
+	TamperLog   bool   // Whether the tamper check logs instead of panicking.
+	IsTesting   string // Expression reporting testing.Testing().
+	TestBinary  bool   // Whether to generate the IsTesting fallback.
+
+	Imports     []string
+	TestImports []string
+
+	Benchmarking bool
+	Fuzzing      bool
+	Coverage     bool
+	Race         bool
+	Sanitizer    bool
+	CoverExclude bool
+	Short        bool
+	Verbose      bool
+	RunFilter    bool
+	TestName     bool
+	TestPath     bool
+	Iteration    bool
+	OnTesting    bool
+	ModeMethod   bool
+	Assert       bool
+
+	DirectlyTested   bool
+	CleanupOnTesting bool
+	OnTestingContext bool
+	Expvar           bool
+	TestMain         bool // Whether to generate a TestMain.
+
+	Export   string // Name of the exported function calling the method.
+	Hook     string // Name of the variable that the importing package sets.
+	Extended string // Name of the hand-written method Extend requires.
+
+	// Probe lists the generated methods that hand-written ones on the
+	// type must not shadow.
+	Probe []string
+
+	// Pointer is whether the package declares a nil pointer to the type,
+	// whose methods are then declared on the pointer type in Delegates.
+	Pointer   bool
+	Delegates []delegate
+}
+
+// A delegate is a method declared on the pointer to the detector type,
+// which calls the one of the same name on a zero override, so that it
+// never dereferences its receiver.
+type delegate struct {
+	Name    string
+	Params  string
+	Args    string
+	Results string
+	Noop    string // Arguments for a call with no further effect.
+}
+
+// delegates returns the methods declared on the pointer to the detector
+// type named typ, one for each generated method.
+func (g *Generator) delegates(typ string) []delegate {
+	ds := []delegate{{Name: g.implMethod(), Results: "bool"}}
+	f := "f func()"
+	if g.OnTestingContext {
+		f = "f func(context.Context)"
+	}
+	for _, name := range g.methods() {
+		d := delegate{Name: name, Results: "bool"}
+		switch name {
+		case "Sanitizer", "RunFilter", "TestName":
+			d.Results = "string"
+		case "TestPath":
+			d.Results = "[]string"
+		case "Iteration":
+			d.Results = "int"
+		case "Mode":
+			d.Results = typ + "Mode"
+		case "OnTesting":
+			d.Params, d.Args, d.Results = f, "f", ""
+			d.Noop = strings.TrimPrefix(f, "f ") + " {}"
+		case "CleanupOnTesting":
+			d.Params, d.Args, d.Results = "f func()", "f", ""
+			d.Noop = "func() {}"
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// typeExprs returns the detector type as it appears in its declaration, in
+// method receivers, and in composite literals.
+func (g *Generator) typeExprs() (decl, recv, inst string) {
+	typ := cmp.Or(g.Type, DefaultType)
+	if len(g.TypeParams) == 0 {
+		return typ, typ, typ
+	}
+	params := strings.Join(g.TypeParams, ", ")
+	args := strings.Repeat("struct{}, ", len(g.TypeParams))
+	return typ + "[" + params + " any]", typ + "[" + params + "]",
+		typ + "[" + strings.TrimSuffix(args, ", ") + "]"
+}
+
+// goVersion returns the Go version the generated code targets, in the
+// go1.N form of [go/version].
+func (g *Generator) goVersion() (string, error) {
+	v := g.GoVersion
+	if v == "" {
+		var err error
+		if v, err = toolchainVersion(); err != nil {
+			return "", err
+		}
+	} else if !strings.HasPrefix(v, "go") {
+		v = "go" + v
+	}
+	if !version.IsValid(v) {
+		return "", fmt.Errorf("bad Go version %q", v)
+	}
+	return version.Lang(v), nil
+}
+
+// implMethod returns the name of the method whose implementations tell
+// binaries apart: the detector method, or with Extend, the flag method the
+// hand-written detector method calls.
+func (g *Generator) implMethod() string {
+	if g.Extend {
+		return cmp.Or(g.Type, DefaultType) + "Flag"
+	}
+	return cmp.Or(g.Method, DefaultMethod)
+}
+
+// methods returns the names of the optional methods g generates.
+func (g *Generator) methods() (names []string) {
+	for _, m := range []struct {
+		on   bool
+		name string
+	}{
+		{g.Benchmarking, "Benchmarking"},
+		{g.Fuzzing, "Fuzzing"},
+		{g.Coverage, "Coverage"},
+		{g.Race, "Race"},
+		{g.Sanitizer, "Sanitizer"},
+		{g.Short, "Short"},
+		{g.Verbose, "Verbose"},
+		{g.DirectlyTested, "DirectlyTested"},
+		{g.RunFilter, "RunFilter"},
+		{g.TestName, "TestName"},
+		{g.TestPath, "TestPath"},
+		{g.Iteration, "Iteration"},
+		{g.OnTesting, "OnTesting"},
+		{g.CleanupOnTesting, "CleanupOnTesting"},
+		{g.ModeMethod, "Mode"},
+	} {
+		if m.on {
+			names = append(names, m.name)
+		}
+	}
+	return names
+}
+
+func checkIdent(kind, name string) error {
+	if name == "_" || !token.IsIdentifier(name) {
+		return fmt.Errorf("bad %s name %q: not a Go identifier", kind, name)
+	}
+	return nil
+}
+
+// exported returns name with its first letter in upper case, for the
+// generated functions that tests call, so that external test packages can
+// call them too.
+func exported(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
+
+// unexported returns name with its first letter in lower case, so that the
+// generated declarations an exported detector type needs internally are not
+// exported along with it.
+func unexported(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[n:]
+}
+
+// snakeCase converts a Go identifier like testingDetector into a file name
+// stem like testing_detector.
+func snakeCase(s string) string {
+	var b strings.Builder
+	r := []rune(s)
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && (!unicode.IsUpper(r[i-1]) ||
+			i+1 < len(r) && unicode.IsLower(r[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
@@ -0,0 +1,3569 @@
+package detect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/token"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, name := range []string{
+		"testing_detector.go",
+		"testing_detector_test.go",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("could not stat %s: %s", name, err)
+		}
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("t.Testing() = false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-v", ".")
+	if want := []byte("t.Testing() = true"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestAssert(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestDetector(t *testing.T) { TestingDetectorAssert(t) }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	// Without NoTamper, the tamper check would catch stale files first.
+	g := &Generator{Assert: true, NoTamper: true}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	goCmd(t, dir, "test", ".")
+
+	// Simulate a stale test file that lost its override.
+	path := filepath.Join(dir, "testing_detector_test.go")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data,
+		[]byte("func (t testingDetectorOverride) Testing() bool "+
+			"{ return true }\n"),
+		nil, 1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "test", ".")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("go test succeeded with stale files, want failure\n%s", out)
+	}
+	want := []byte("testingDetector.Testing() = false in a test binary")
+	if !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestRace(t *testing.T) {
+	dir := t.TempDir()
+	cgo := goCmd(t, dir, "env", "CGO_ENABLED")
+	if string(bytes.TrimSpace(cgo)) != "1" {
+		t.Skip("-race requires cgo")
+	}
+	var program = []byte(`package main
+
+var t testingDetector
+
+func init() {
+	go func() {
+		for {
+			_ = t.Testing()
+		}
+	}()
+}
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "test", "-race", "-v", ".")
+	if want := []byte("t.Testing() = true"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "run", "-race", ".")
+	if want := []byte("t.Testing() = false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+import "example.com/pkg/lib"
+
+func main() { println("lib.Testing() =", lib.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	var lib = []byte(`package lib
+
+var t testingDetector
+
+func Testing() bool { return t.Testing() }
+`)
+	writeFile(t, dir, "lib/lib.go", lib)
+	var libTests = []byte(`package lib
+
+import "testing"
+
+func TestTesting(t *testing.T) {
+	if !Testing() {
+		t.Error("Testing() = false, want true")
+	}
+}
+`)
+	writeFile(t, dir, "lib/lib_test.go", libTests)
+	modInit(t, dir)
+	if err := Generate(filepath.Join(dir, "lib")); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("lib.Testing() = false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-v", ".")
+	if want := []byte("lib.Testing() = true"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-cover", "./lib")
+	if want := []byte("coverage: 100.0%"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestNilPointer(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+import "example.com/pkg/lib"
+
+func main() { println("lib.Testing() =", lib.Testing()) }
+`))
+	writeFile(t, dir, "lib/lib.go", []byte(`package lib
+
+import "context"
+
+var t *testingDetector
+
+func Testing() bool {
+	t.OnTesting(func(context.Context) {})
+	t.CleanupOnTesting(func() {})
+	_, _, _, _ = t.RunFilter(), t.TestPath(), t.Iteration(), t.Mode()
+	return t.Testing()
+}
+`))
+	writeFile(t, dir, "lib/lib_test.go", []byte(`package lib
+
+import (
+	"expvar"
+	"testing"
+)
+
+func TestTesting(tt *testing.T) {
+	calls := expvar.Get("testingDetector.Testing").(*expvar.Int)
+	if got := calls.Value(); got != 0 {
+		tt.Errorf("counted %d calls to Testing() before any, want 0", got)
+	}
+	if !Testing() {
+		tt.Error("Testing() = false, want true")
+	}
+}
+`))
+	modInit(t, dir)
+	g := &Generator{
+		CoverExclude: true,
+		RunFilter:    true,
+		TestPath:     true,
+		Iteration:    true,
+		OnTesting:    true,
+		ModeMethod:   true,
+
+		CleanupOnTesting: true,
+		OnTestingContext: true,
+		Expvar:           true,
+	}
+	if err := g.Generate(filepath.Join(dir, "lib")); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	goCmd(t, dir, "vet", "./...")
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("lib.Testing() = false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-cover", "./lib")
+	if want := []byte("coverage: 100.0%"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestCleanupOnTesting(t *testing.T) {
+	program := []byte(`package main
+
+var t testingDetector
+
+func init() {
+	t.CleanupOnTesting(func() { println("cleanup: first") })
+	t.CleanupOnTesting(func() { println("cleanup: second") })
+}
+
+func main() { println("main") }
+`)
+	tests := []byte(`package main
+
+import "testing"
+
+func TestProgram(t *testing.T) { main() }
+`)
+	testMain := []byte(`package main
+
+import "testing"
+
+func TestMain(m *testing.M) {
+	m.Run()
+	println("TestMain")
+	TestingDetectorRunCleanups()
+}
+
+func TestProgram(t *testing.T) { main() }
+`)
+	for _, tt := range []struct {
+		name  string
+		tests []byte
+		after string
+	}{
+		{"generated TestMain", tests, "PASS"},
+		{"own TestMain", testMain, "TestMain"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "main.go", program)
+			writeFile(t, dir, "main_test.go", tt.tests)
+			modInit(t, dir)
+			g := &Generator{CleanupOnTesting: true}
+			if err := g.Generate(dir); err != nil {
+				t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+			}
+			out := goCmd(t, dir, "run", ".")
+			if bytes.Contains(out, []byte("cleanup")) {
+				t.Errorf("go run ran cleanups\n%s", out)
+			}
+			out = goCmd(t, dir, "test", "-v", ".")
+			after := bytes.Index(out, []byte(tt.after+"\n"))
+			second := bytes.Index(out, []byte("cleanup: second"))
+			first := bytes.Index(out, []byte("cleanup: first"))
+			if after < 0 || second < after || first < second {
+				t.Errorf("go test did not run cleanups in reverse "+
+					"order after %s\n%s", tt.after, out)
+			}
+		})
+	}
+}
+
+func TestOnTestingContext(t *testing.T) {
+	program := []byte(`package main
+
+import "context"
+
+var (
+	t   testingDetector
+	ctx context.Context
+)
+
+func init() {
+	t.OnTesting(func(c context.Context) { ctx = c })
+	t.CleanupOnTesting(func() { println("cancelled:", ctx.Err() != nil) })
+}
+
+func main() { println("main") }
+`)
+	tests := []byte(`package main
+
+import "testing"
+
+func TestProgram(t *testing.T) {
+	if err := ctx.Err(); err != nil {
+		t.Errorf("ctx.Err() = %v while tests run, want <nil>", err)
+	}
+}
+`)
+	testMain := []byte(`package main
+
+import "testing"
+
+func TestMain(m *testing.M) {
+	m.Run()
+	println("TestMain")
+	TestingDetectorCancelOnTesting()
+	TestingDetectorRunCleanups()
+}
+
+func TestProgram(t *testing.T) {
+	if err := ctx.Err(); err != nil {
+		t.Errorf("ctx.Err() = %v while tests run, want <nil>", err)
+	}
+}
+`)
+	for _, tt := range []struct {
+		name  string
+		tests []byte
+		after string
+	}{
+		{"generated TestMain", tests, "PASS"},
+		{"own TestMain", testMain, "TestMain"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "main.go", program)
+			writeFile(t, dir, "main_test.go", tt.tests)
+			modInit(t, dir)
+			g := &Generator{
+				OnTesting:        true,
+				OnTestingContext: true,
+				CleanupOnTesting: true,
+			}
+			if err := g.Generate(dir); err != nil {
+				t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+			}
+			out := goCmd(t, dir, "run", ".")
+			if bytes.Contains(out, []byte("cancelled")) {
+				t.Errorf("go run ran cleanups\n%s", out)
+			}
+			out = goCmd(t, dir, "test", "-v", ".")
+			after := bytes.Index(out, []byte(tt.after+"\n"))
+			cancelled := bytes.Index(out, []byte("cancelled: true"))
+			if after < 0 || cancelled < after {
+				t.Errorf("go test did not cancel the context after %s\n%s",
+					tt.after, out)
+			}
+		})
+	}
+	err := (&Generator{OnTestingContext: true}).Generate(t.TempDir())
+	if err == nil {
+		t.Error("Generate with OnTestingContext alone = <nil>, want error")
+	}
+}
+
+func TestExternalTestPackage(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "pkg.go", []byte(`package pkg
+
+import "context"
+
+var (
+	t   testingDetector
+	ctx context.Context
+)
+
+func init() {
+	t.OnTesting(func(c context.Context) { ctx = c })
+	t.CleanupOnTesting(func() { println("cancelled:", ctx.Err() != nil) })
+}
+
+func TestName() string { return t.TestName() }
+`))
+	writeFile(t, dir, "pkg_test.go", []byte(`package pkg_test
+
+import (
+	"testing"
+
+	"example.com/pkg"
+)
+
+func TestMain(m *testing.M) {
+	m.Run()
+	pkg.TestingDetectorCancelOnTesting()
+	pkg.TestingDetectorRunCleanups()
+}
+
+func TestExternal(t *testing.T) {
+	pkg.TestingDetectorAssert(t)
+	pkg.TestingDetectorRegister(t)
+	if got := pkg.TestName(); got != t.Name() {
+		t.Errorf("TestName() = %q, want %q", got, t.Name())
+	}
+}
+`))
+	modInit(t, dir)
+	g := &Generator{
+		Assert:           true,
+		TestName:         true,
+		OnTesting:        true,
+		OnTestingContext: true,
+		CleanupOnTesting: true,
+	}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "test", "-v", ".")
+	if want := []byte("cancelled: true"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestDirectlyTested(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+import "example.com/pkg/lib"
+
+func main() { println("lib.Direct() =", lib.Direct()) }
+`))
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import (
+	"testing"
+
+	"example.com/pkg/lib"
+)
+
+func TestDirect(t *testing.T) {
+	if lib.Direct() {
+		t.Error("lib.Direct() = true in an importing test, want false")
+	}
+	main()
+}
+`))
+	writeFile(t, dir, "lib/lib.go", []byte(`package lib
+
+var t testingDetector
+
+func Direct() bool { return t.DirectlyTested() }
+`))
+	writeFile(t, dir, "lib/lib_test.go", []byte(`package lib
+
+import "testing"
+
+func TestDirect(t *testing.T) {
+	if !Direct() {
+		t.Error("Direct() = false in its own test, want true")
+	}
+}
+`))
+	modInit(t, dir)
+	g := &Generator{DirectlyTested: true}
+	if err := g.Generate(filepath.Join(dir, "lib")); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("lib.Direct() = false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", ".")
+	out = goCmd(t, dir, "test", "-cover", "./lib")
+	if want := []byte("coverage: 100.0%"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestExportedType(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "shared/shared.go", []byte(`package shared
+
+var Detector TestingDetector
+`))
+	for _, name := range []string{"a", "b"} {
+		writeFile(t, dir, name+"/main.go", []byte(`package main
+
+import "example.com/pkg/shared"
+
+func main() { println("`+name+`:", shared.Detector.Testing()) }
+`))
+		writeFile(t, dir, name+"/main_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`))
+	}
+	modInit(t, dir)
+	g := &Generator{Type: "TestingDetector", Race: true}
+	if err := g.Generate(filepath.Join(dir, "shared")); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "shared/testing_detector.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"TestingDetectorEmbed",
+		"TestingDetectorRace",
+	} {
+		if bytes.Contains(data, []byte(name)) {
+			t.Errorf("testing_detector.go exports %s\n%s", name, data)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		out := goCmd(t, dir, "run", "./"+name)
+		if want := []byte(name + ": false"); !bytes.Contains(out, want) {
+			t.Errorf("go run output did not contain %q\n%s", want, out)
+		}
+		out = goCmd(t, dir, "test", "-v", "./"+name)
+		if want := []byte(name + ": true"); !bytes.Contains(out, want) {
+			t.Errorf("go test output did not contain %q\n%s", want, out)
+		}
+	}
+}
+
+func TestMultipleVars(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+func main() { println("net, db =", netTesting(), dbTesting()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var netSrc = []byte(`package main
+
+var net testingDetector
+
+func netTesting() bool { return net.Testing() }
+`)
+	writeFile(t, dir, "net.go", netSrc)
+	var dbSrc = []byte(`package main
+
+var db = new(testingDetector)
+
+func dbTesting() bool { return db.Testing() }
+`)
+	writeFile(t, dir, "db.go", dbSrc)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("net, db = false false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-v", ".")
+	if want := []byte("net, db = true true"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+type tester interface{ Testing() bool }
+
+var t testingDetector
+
+var global tester = &t
+
+func local() bool {
+	var d tester = t
+	return d.Testing()
+}
+
+func main() { println("global, local =", global.Testing(), local()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	g := &Generator{Report: new(Report)}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	got, want := g.Report.Packages[0].Vars, []string{"global", "t"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Vars = %q, want %q", got, want)
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("global, local = false false"); !bytes.Contains(
+		out, want,
+	) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-v", ".")
+	if want := []byte("global, local = true true"); !bytes.Contains(
+		out, want,
+	) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestOut(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	g := &Generator{Out: "internal_testdetect"}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, name := range []string{
+		"internal_testdetect.go",
+		"internal_testdetect_test.go",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("could not stat %s: %s", name, err)
+		}
+	}
+	out := goCmd(t, dir, "test", "-v", ".")
+	if want := []byte("t.Testing() = true"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+	if err := g.Generate(dir); err != nil {
+		t.Errorf("second Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+
+	g.Out = "main"
+	err := g.Generate(dir)
+	if err == nil || !strings.Contains(err.Error(), "not generated") {
+		t.Errorf("Generate(%q) with Out %q = %v, want collision error",
+			dir, g.Out, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "main.go")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, program) {
+		t.Errorf("Generate(%q) with Out %q modified main.go", dir, g.Out)
+	}
+
+	for _, out := range []string{"sub/name", ".hidden", "_name", "name_test",
+		"name.go"} {
+		g := &Generator{Out: out}
+		if err := g.Generate(dir); err == nil {
+			t.Errorf("Generate(%q) with Out %q = <nil>, want error",
+				dir, out)
+		}
+	}
+}
+
+func TestForce(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	writeFile(t, dir, "main.go", program)
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	path := filepath.Join(dir, "testing_detector.go")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edited, _ := bytes.Cut(data, []byte("\n"))
+	edited = append(edited, "\n// Edited by hand.\n"...)
+	writeFile(t, dir, "testing_detector.go", edited)
+
+	err = Generate(dir)
+	if err == nil || !strings.Contains(err.Error(), "not generated") {
+		t.Errorf("Generate(%q) over edited file = %v, want refusal",
+			dir, err)
+	}
+	if got, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, edited) {
+		t.Errorf("Generate(%q) overwrote the edited file", dir)
+	}
+
+	if err := (&Generator{Force: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) with Force = %q, want <nil>", dir, err)
+	}
+	if got, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("Generate(%q) with Force wrote\n%s\nwant\n%s",
+			dir, got, data)
+	}
+}
+
+func TestGeneric(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var (
+	t testingDetector[int]
+	u = new(testingDetector[string])
+)
+
+func main() { println("testing:", t.Testing(), u.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestTesting(tt *testing.T) {
+	if !t.Testing() || !u.Testing() {
+		tt.Error("Testing() = false, want true")
+	}
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+
+	err := Generate(dir)
+	if err == nil || !strings.Contains(err.Error(), "TypeParams is empty") {
+		t.Errorf("Generate(%q) = %v, want type arguments error", dir, err)
+	}
+	g := &Generator{TypeParams: []string{"T", "U"}}
+	err = g.Generate(dir)
+	if err == nil || !strings.Contains(err.Error(), "has 1 type arguments") {
+		t.Errorf("Generate(%q) with TypeParams %q = %v, "+
+			"want type arguments error", dir, g.TypeParams, err)
+	}
+	bare := filepath.Join(dir, "bare.go")
+	writeFile(t, dir, "bare.go", []byte(`package main
+
+var _ testingDetector
+`))
+	g = &Generator{TypeParams: []string{"T"}}
+	err = g.Generate(dir)
+	want := bare + ":3:7: testingDetector has no type arguments, " +
+		"but TypeParams has 1"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Generate(%q) with TypeParams %q = %v, want error "+
+			"containing %q", dir, g.TypeParams, err, want)
+	}
+	if err := os.Remove(bare); err != nil {
+		t.Fatal(err)
+	}
+	g = &Generator{TypeParams: []string{"T"}, ModeMethod: true}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("testing: false false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "vet", ".")
+	goCmd(t, dir, "test", ".")
+
+	for _, params := range [][]string{{"T", "T"}, {"any"}, {"1"}} {
+		g := &Generator{TypeParams: params}
+		if err := g.Generate(dir); err == nil {
+			t.Errorf("Generate(%q) with TypeParams %q = <nil>, want error",
+				dir, params)
+		}
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	g := &Generator{Mode: ModeBuildTag}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, name := range []string{
+		"testing_detector.go",
+		"testing_detector_testdetect.go",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("could not stat %s: %s", name, err)
+		}
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"run", "."}, "t.Testing() = false"},
+		{[]string{"run", "-tags", "testdetect", "."}, "t.Testing() = true"},
+		{[]string{"test", "-v", "."}, "t.Testing() = false"},
+		{[]string{"test", "-v", "-tags", "testdetect", "."},
+			"t.Testing() = true"},
+	} {
+		out := goCmd(t, dir, tt.args...)
+		if !bytes.Contains(out, []byte(tt.want)) {
+			t.Errorf("go %s output did not contain %q\n%s",
+				strings.Join(tt.args, " "), tt.want, out)
+		}
+	}
+	g.Short = true
+	if err := g.Generate(dir); err == nil {
+		t.Errorf("Generate(%q) with Short = <nil>, want error", dir)
+	}
+}
+
+func TestBuildConstraint(t *testing.T) {
+	dir := t.TempDir()
+	var linux = []byte(`//go:build linux
+
+package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", linux)
+	var darwin = []byte(`//go:build darwin
+
+package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "darwin.go", darwin)
+	var other = []byte(`//go:build !linux && !darwin
+
+package main
+
+func main() {}
+`)
+	writeFile(t, dir, "other.go", other)
+	var tests = []byte(`//go:build linux
+
+package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	for _, tt := range []struct {
+		g     Generator
+		files map[string]string
+	}{
+		{Generator{}, map[string]string{
+			"testing_detector.go":      "linux || darwin",
+			"testing_detector_test.go": "linux || darwin",
+		}},
+		{Generator{Mode: ModeBuildTag}, map[string]string{
+			"testing_detector.go": "(linux || darwin) && !testdetect",
+			"testing_detector_testdetect.go": "(linux || darwin) && " +
+				"testdetect",
+		}},
+	} {
+		old, err := filepath.Glob(filepath.Join(dir, "testing_detector*.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range old {
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tt.g.Generate(dir); err != nil {
+			t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+		}
+		for name, expr := range tt.files {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []byte("\n//go:build " + expr + "\n")
+			if !bytes.Contains(data, want) {
+				t.Errorf("%s did not contain %q\n%s", name, want, data)
+			}
+		}
+		for _, goos := range []string{"linux", "darwin", "windows"} {
+			cmd := exec.Command("go", "vet", ".")
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "GOOS="+goos)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("GOOS=%s go vet failed: %s\n%s", goos, err, out)
+			}
+		}
+	}
+}
+
+func TestPlusBuild(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`// +build linux darwin
+// +build amd64 arm64
+
+// Package doc comments may mention // +build lines without effect.
+package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var other = []byte(`// +build !linux,!darwin !amd64,!arm64
+
+package main
+
+func main() {}
+`)
+	writeFile(t, dir, "other.go", other)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, name := range []string{
+		"testing_detector.go",
+		"testing_detector_test.go",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []byte("\n//go:build (linux || darwin) && (amd64 || arm64)\n")
+		if !bytes.Contains(data, want) {
+			t.Errorf("%s did not contain %q\n%s", name, want, data)
+		}
+	}
+	for _, env := range [][]string{
+		{"GOOS=linux", "GOARCH=amd64"},
+		{"GOOS=darwin", "GOARCH=arm64"},
+		{"GOOS=linux", "GOARCH=386"},
+		{"GOOS=windows", "GOARCH=amd64"},
+	} {
+		cmd := exec.Command("go", "test", "-c", "-o", os.DevNull, ".")
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), env...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("%s go test -c failed: %s\n%s", env, err, out)
+		}
+	}
+	goCmd(t, dir, "test", ".")
+}
+
+func TestBenchmarking(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func mode() string {
+	switch {
+	case t.Benchmarking():
+		return "benchmark"
+	case t.Testing():
+		return "test"
+	default:
+		return "program"
+	}
+}
+
+func main() { println("mode:", mode()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMode(t *testing.T) {
+	if got, want := mode(), "test"; got != want {
+		t.Errorf("mode() = %q, want %q", got, want)
+	}
+}
+
+func BenchmarkMode(b *testing.B) {
+	if got, want := mode(), "benchmark"; got != want {
+		b.Errorf("mode() = %q, want %q", got, want)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if got, want := mode(), "benchmark"; got != want {
+				b.Errorf("mode() = %q, want %q", got, want)
+			}
+		}
+	})
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{Benchmarking: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("mode: program"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", "-bench=.", "-benchtime=10x", ".")
+}
+
+func TestFuzzing(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func mode() string {
+	switch {
+	case t.Fuzzing():
+		return "fuzz"
+	case t.Testing():
+		return "test"
+	default:
+		return "program"
+	}
+}
+
+func main() { println("mode:", mode()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func FuzzMode(f *testing.F) {
+	if got, want := mode(), "test"; got != want {
+		f.Errorf("mode() = %q, want %q", got, want)
+	}
+	f.Add(1)
+	f.Fuzz(func(t *testing.T, _ int) {
+		if got, want := mode(), "fuzz"; got != want {
+			t.Errorf("mode() = %q, want %q", got, want)
+		}
+	})
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{Fuzzing: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("mode: program"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", ".")
+	goCmd(t, dir, "test", "-run=^$", "-fuzz=FuzzMode", "-fuzztime=10x", ".")
+}
+
+func TestShort(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func mode() string {
+	switch {
+	case t.Short():
+		return "short"
+	case t.Testing():
+		return "test"
+	default:
+		return "program"
+	}
+}
+
+func main() { println("mode:", mode()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMode(t *testing.T) { println("test mode:", mode()) }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{Short: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("mode: program"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-count=1", "-v", ".")
+	if want := []byte("test mode: test"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-count=1", "-v", "-short", ".")
+	if want := []byte("test mode: short"); !bytes.Contains(out, want) {
+		t.Errorf("go test -short output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func mode() string {
+	switch {
+	case t.Verbose():
+		return "verbose"
+	case t.Testing():
+		return "test"
+	default:
+		return "program"
+	}
+}
+
+func main() { println("mode:", mode()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMode(t *testing.T) {
+	if got, want := mode(), os.Getenv("WANT"); got != want {
+		t.Errorf("mode() = %q, want %q", got, want)
+	}
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{Verbose: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("mode: program"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	t.Setenv("WANT", "test")
+	goCmd(t, dir, "test", "-count=1", ".")
+	t.Setenv("WANT", "verbose")
+	goCmd(t, dir, "test", "-count=1", "-v", ".")
+}
+
+func TestOffTag(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+import "example.com/pkg/lib"
+
+var t testingDetector
+
+func main() { println(t.Testing(), lib.Testing()) }
+`))
+	writeFile(t, dir, "lib/lib.go", []byte(`package lib
+
+var t testingDetector
+
+func Testing() bool { return t.Testing() }
+`))
+	var tests = []byte(`package %s
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOff(tt *testing.T) {
+	if got, want := t.Testing(), os.Getenv("WANT") == "true"; got != want {
+		tt.Errorf("Testing() = %%t, want %%t", got, want)
+	}
+}
+`)
+	for path, pkg := range map[string]string{
+		"main_test.go":    "main",
+		"lib/lib_test.go": "lib",
+	} {
+		writeFile(t, dir, path, fmt.Appendf(nil, string(tests), pkg))
+	}
+	modInit(t, dir)
+	g := &Generator{OffTag: true}
+	if _, err := g.GenerateAll(dir, "./..."); err != nil {
+		t.Fatalf("GenerateAll(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, path := range []string{
+		"testing_detector_off.go", "lib/testing_detector_off.go",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("GenerateAll(%q) did not write %s: %s", dir, path, err)
+		}
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("false false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "run", "-tags", OffTag, ".")
+	if want := []byte("false false"); !bytes.Contains(out, want) {
+		t.Errorf("go run -tags %s output did not contain %q\n%s",
+			OffTag, want, out)
+	}
+	t.Setenv("WANT", "true")
+	goCmd(t, dir, "test", "-count=1", "./...")
+	t.Setenv("WANT", "false")
+	goCmd(t, dir, "test", "-count=1", "-tags", OffTag, "./...")
+	goCmd(t, dir, "vet", "-tags", OffTag, "./...")
+
+	g.Assert = true
+	if err := g.Generate(dir); err == nil {
+		t.Errorf("Generate(%q) with Assert and OffTag = <nil>, want error",
+			dir)
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() { println("testing:", t.Testing()) }
+`))
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import (
+	"expvar"
+	"testing"
+)
+
+func TestCalls(tt *testing.T) {
+	calls := expvar.Get("testingDetector.Testing").(*expvar.Int)
+	before := calls.Value()
+	for range 3 {
+		t.Testing()
+	}
+	if got := calls.Value() - before; got != 3 {
+		tt.Errorf("counted %d calls to Testing(), want 3", got)
+	}
+}
+`))
+	modInit(t, dir)
+	if err := (&Generator{Expvar: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	goCmd(t, dir, "test", "-count=1", ".")
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("testing: false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "testing_detector.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("expvar")) {
+		t.Errorf("testing_detector.go refers to expvar\n%s", data)
+	}
+}
+
+func TestMultipleTypes(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var (
+	net netDetector
+	db  dbDetector
+)
+
+func main() { println("testing:", net.Testing(), db.Testing()) }
+`))
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import "testing"
+
+func TestTypes(t *testing.T) {
+	if !net.Testing() || !db.Testing() {
+		t.Error("Testing() = false, want true")
+	}
+	if !net.Short() || !db.Short() {
+		t.Error("Short() = false, want true")
+	}
+	ran := 0
+	net.OnTesting(func() { ran++ })
+	db.OnTesting(func() { ran++ })
+	if ran != 2 {
+		t.Errorf("OnTesting ran %d functions, want 2", ran)
+	}
+}
+`))
+	modInit(t, dir)
+	for _, typ := range []string{"netDetector", "dbDetector"} {
+		g := &Generator{Type: typ, Short: true, OnTesting: true,
+			Coverage: true, Race: true, Expvar: true}
+		if err := g.Generate(dir); err != nil {
+			t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+		}
+	}
+	goCmd(t, dir, "vet", ".")
+	goCmd(t, dir, "test", "-count=1", "-short", ".")
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("testing: false false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+
+	// A generated TestMain only runs the cleanups of its own type, so a
+	// second type that needs one must not rely on it.
+	g := &Generator{Type: "netDetector", CleanupOnTesting: true}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	g = &Generator{Type: "dbDetector", CleanupOnTesting: true}
+	err := g.Generate(dir)
+	if want := "TestMain is generated for another detector type"; err == nil ||
+		!strings.Contains(err.Error(), want) {
+		t.Errorf("Generate(%q) = %v, want error containing %q", dir, err,
+			want)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() { println("testing:", t.Testing()) }
+`))
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(tt *testing.T) {
+	if !t.Testing() {
+		tt.Error("Testing() = false, want true")
+	}
+}
+`))
+	modInit(t, dir)
+	if err := (&Generator{Guard: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	goCmd(t, dir, "build", "./...")
+	goCmd(t, dir, "vet", "./...")
+	goCmd(t, dir, "test", "-count=1", "./...")
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("testing: false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "list", "-tags", IgnoreTag,
+		"-f", "{{.GoFiles}} {{.IgnoredGoFiles}} {{.TestGoFiles}}", ".")
+	if want := "[main.go testing_detector_ignore.go] " +
+		"[testing_detector.go testing_detector_test.go] " +
+		"[main_test.go]"; !bytes.Contains(out, []byte(want)) {
+		t.Errorf("go list -tags %s = %s, want %s", IgnoreTag, out, want)
+	}
+	goCmd(t, dir, "build", "-tags", IgnoreTag, "./...")
+	goCmd(t, dir, "vet", "-tags", IgnoreTag, "./...")
+}
+
+func TestModeMethod(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+import "fmt"
+
+var t testingDetector
+
+func mode() testingDetectorMode { return t.Mode() }
+
+func main() { fmt.Printf("mode: %+v\n", mode()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMode(t *testing.T) {
+	got := mode()
+	want := testingDetectorMode{
+		Testing:  true,
+		Coverage: testing.CoverMode() != "",
+		Short:    testing.Short(),
+	}
+	if got != want {
+		t.Errorf("mode() = %+v, want %+v", got, want)
+	}
+	fmt.Printf("test mode: %+v\n", got)
+}
+
+func BenchmarkMode(b *testing.B) {
+	if got := mode(); !got.Benchmarking || got.Fuzzing {
+		b.Errorf("mode() = %+v, want Benchmarking only", got)
+	}
+}
+
+func FuzzMode(f *testing.F) {
+	f.Add(1)
+	f.Fuzz(func(t *testing.T, _ int) {
+		if got := mode(); !got.Fuzzing || got.Benchmarking {
+			t.Errorf("mode() = %+v, want Fuzzing only", got)
+		}
+	})
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{ModeMethod: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	want := []byte("mode: {Testing:false Benchmarking:false Fuzzing:false " +
+		"Coverage:false Short:false}")
+	if !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	for _, tt := range []struct {
+		flags []string
+		want  string
+	}{
+		{nil, "Testing:true Benchmarking:false Fuzzing:false " +
+			"Coverage:false Short:false"},
+		{[]string{"-short"}, "Short:true"},
+		{[]string{"-cover"}, "Coverage:true"},
+	} {
+		args := slices.Concat([]string{"test", "-count=1", "-v",
+			"-run=TestMode"}, tt.flags, []string{"."})
+		out := goCmd(t, dir, args...)
+		if !bytes.Contains(out, []byte(tt.want)) {
+			t.Errorf("go test %q output did not contain %q\n%s",
+				tt.flags, tt.want, out)
+		}
+	}
+	goCmd(t, dir, "test", "-run=^$", "-bench=.", "-benchtime=10x", ".")
+	goCmd(t, dir, "test", "-run=^$", "-fuzz=FuzzMode", "-fuzztime=10x", ".")
+}
+
+func TestRunFilter(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func filter() string { return t.RunFilter() }
+
+func main() { println("filter:", filter()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestFoo(t *testing.T) { println("test filter:", filter()) }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{RunFilter: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("filter: \n"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "test filter: \n"},
+		{[]string{"-run", "TestFoo"}, "test filter: TestFoo\n"},
+		{[]string{"-run", "^TestF.*$/sub"}, "test filter: ^TestF.*$/sub\n"},
+	} {
+		args := append([]string{"test", "-count=1", "-v"}, tt.args...)
+		out := goCmd(t, dir, append(args, ".")...)
+		if !bytes.Contains(out, []byte(tt.want)) {
+			t.Errorf("go %q output did not contain %q\n%s",
+				args, tt.want, out)
+		}
+	}
+}
+
+func TestRaceMethod(t *testing.T) {
+	dir := t.TempDir()
+	cgo := goCmd(t, dir, "env", "CGO_ENABLED")
+	if string(bytes.TrimSpace(cgo)) != "1" {
+		t.Skip("-race requires cgo")
+	}
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("race:", t.Race()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{Race: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"run", "."}, "race: false\n"},
+		{[]string{"test", "-count=1", "-v", "."}, "race: false\n"},
+		{[]string{"test", "-count=1", "-v", "-race", "."}, "race: true\n"},
+	} {
+		out := goCmd(t, dir, tt.args...)
+		if !bytes.Contains(out, []byte(tt.want)) {
+			t.Errorf("go %q output did not contain %q\n%s",
+				tt.args, tt.want, out)
+		}
+	}
+}
+
+func TestSanitizer(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("sanitizer:", t.Sanitizer()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{Sanitizer: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("sanitizer: \n"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", "-count=1", ".")
+
+	// Each sanitizer needs cgo and a C toolchain supporting it, so only
+	// test those that build a bare program here.
+	probe := t.TempDir()
+	writeFile(t, probe, "main.go", []byte("package main\n\nfunc main() {}\n"))
+	modInit(t, probe)
+	for _, name := range []string{"race", "msan", "asan"} {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("go", "run", "-"+name, ".")
+			cmd.Dir = probe
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Skipf("go run -%s failed: %s\n%s", name, err, out)
+			}
+			want := []byte("sanitizer: " + name + "\n")
+			for _, args := range [][]string{
+				{"run", "-" + name, "."},
+				{"test", "-count=1", "-v", "-" + name, "."},
+			} {
+				out := goCmd(t, dir, args...)
+				if !bytes.Contains(out, want) {
+					t.Errorf("go %q output did not contain %q\n%s",
+						args, want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestProgramFlags(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var t testingDetector
+
+var loud = flag.Bool("loud", false, "shout")
+
+func report() string {
+	return fmt.Sprintf("loud=%t short=%t verbose=%t run=%q",
+		*loud, t.Short(), t.Verbose(), t.RunFilter())
+}
+
+func main() {
+	flag.Parse()
+	fmt.Println(report())
+}
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestReport(tt *testing.T) { tt.Log(report()) }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	g := &Generator{Short: true, Verbose: true, RunFilter: true}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".", "-loud")
+	want := []byte(`loud=true short=false verbose=false run=""`)
+	if !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	// The program binary registers no flags besides its own.
+	cmd := exec.Command("go", "run", ".", "-h")
+	cmd.Dir = dir
+	out, _ = cmd.CombinedOutput()
+	if !bytes.Contains(out, []byte("-loud")) ||
+		bytes.Contains(out, []byte("test.")) {
+		t.Errorf("go run . -h listed other flags than -loud\n%s", out)
+	}
+	out = goCmd(t, dir, "test", "-count=1", "-v", "-short",
+		"-run", "TestReport", ".", "-args", "-loud")
+	want = []byte(`loud=true short=true verbose=true run="TestReport"`)
+	if !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestBackingFunc(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("testing:", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	main()
+	testingDetectorBacking = func() bool { return true }
+	main()
+	os.Exit(m.Run())
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	g := &Generator{Backing: BackingFunc}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("testing: false\n"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-count=1", "-v", ".")
+	want := []byte("testing: false\ntesting: true\n")
+	if !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+
+	if err := (&Generator{
+		Backing: BackingFunc,
+		Mode:    ModeBuildTag,
+	}).Generate(dir); err == nil {
+		t.Error("Generate() with ModeBuildTag and BackingFunc succeeded")
+	}
+	if err := (&Generator{Backing: "var"}).Generate(dir); err == nil {
+		t.Error(`Generate() with Backing "var" succeeded`)
+	}
+}
+
+func TestGoVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version   string
+		hook, not string
+	}{
+		{"1.20", "testingDetectorTestBinary()", "testing.Testing()"},
+		{"go1.21", "testing.Testing()", "TestBinary"},
+	} {
+		t.Run(tt.version, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "main.go", []byte(`package main
+
+import "example.com/pkg/lib"
+
+var t testingDetector
+
+func main() { println("testing:", t.Testing(), lib.Testing()) }
+`))
+			writeFile(t, dir, "main_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`))
+			writeFile(t, dir, "lib/lib.go", []byte(`package lib
+
+var t testingDetector
+
+func Testing() bool { return t.Testing() }
+`))
+			modInit(t, dir)
+			goCmd(t, dir, "mod", "edit", "-go="+strings.TrimPrefix(
+				tt.version, "go"))
+			g := &Generator{GoVersion: tt.version}
+			for _, pkg := range []string{dir, filepath.Join(dir, "lib")} {
+				if err := g.Generate(pkg); err != nil {
+					t.Fatalf("Generate(%q) = %q, want <nil>", pkg, err)
+				}
+				path := filepath.Join(pkg, "testing_detector.go")
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Contains(data, []byte(tt.hook)) {
+					t.Errorf("%s did not contain %q\n%s",
+						path, tt.hook, data)
+				}
+				if bytes.Contains(data, []byte(tt.not)) {
+					t.Errorf("%s contains %q\n%s", path, tt.not, data)
+				}
+			}
+			goCmd(t, dir, "vet", "./...")
+			out := goCmd(t, dir, "run", ".")
+			if want := []byte("testing: false false\n"); !bytes.Contains(
+				out, want) {
+				t.Errorf("go run output did not contain %q\n%s",
+					want, out)
+			}
+			out = goCmd(t, dir, "test", "-count=1", "-v", ".")
+			if want := []byte("testing: true true\n"); !bytes.Contains(
+				out, want) {
+				t.Errorf("go test output did not contain %q\n%s",
+					want, out)
+			}
+		})
+	}
+	for _, g := range []*Generator{
+		{GoVersion: "1.17"},
+		{GoVersion: "latest"},
+		{GoVersion: "1.20", Coverage: true},
+	} {
+		if err := g.validate(); !errors.Is(err, ErrOption) {
+			t.Errorf("validate() with %+v = %v, want %q", *g, err, ErrOption)
+		}
+	}
+}
+
+func TestTestName(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func name() string { return t.TestName() }
+
+func main() { println("name:", name()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestName(t *testing.T) {
+	if got := name(); got != "" {
+		t.Errorf("name() = %q before register, want empty", got)
+	}
+	TestingDetectorRegister(t)
+	if got, want := name(), "TestName"; got != want {
+		t.Errorf("name() = %q, want %q", got, want)
+	}
+	t.Run("sub", func(t *testing.T) {
+		TestingDetectorRegister(t)
+		if got, want := name(), "TestName/sub"; got != want {
+			t.Errorf("name() = %q, want %q", got, want)
+		}
+	})
+	if got, want := name(), "TestName"; got != want {
+		t.Errorf("name() = %q after subtest, want %q", got, want)
+	}
+}
+
+func TestNameAfter(t *testing.T) {
+	if got := name(); got != "" {
+		t.Errorf("name() = %q, want empty", got)
+	}
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{TestName: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("name: \n"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", ".")
+}
+
+func TestTestPath(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+import "fmt"
+
+var t testingDetector
+
+func path() []string { return t.TestPath() }
+
+func main() { fmt.Printf("path: %q\n", path()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func want(t *testing.T, want ...string) {
+	t.Helper()
+	if got := path(); !slices.Equal(got, want) {
+		t.Errorf("path() = %q, want %q", got, want)
+	}
+}
+
+func TestPath(t *testing.T) {
+	want(t)
+	TestingDetectorRegister(t)
+	want(t, "TestPath")
+	t.Run("group", func(t *testing.T) {
+		TestingDetectorRegister(t)
+		want(t, "TestPath", "group")
+		for _, name := range []string{"case1", "case2"} {
+			t.Run(name, func(t *testing.T) {
+				TestingDetectorRegister(t)
+				want(t, "TestPath", "group", name)
+			})
+		}
+		want(t, "TestPath", "group")
+	})
+	want(t, "TestPath")
+}
+
+func TestPathAfter(t *testing.T) {
+	if got := path(); got != nil {
+		t.Errorf("path() = %q, want nil", got)
+	}
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{TestPath: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("path: []\n"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", ".")
+}
+
+func TestIteration(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("iteration:", t.Iteration()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+var runs int
+
+func want(t *testing.T, want int) {
+	t.Helper()
+	if got := (testingDetector{}).Iteration(); got != want {
+		t.Errorf("Iteration() = %d, want %d", got, want)
+	}
+}
+
+func TestIteration(t *testing.T) {
+	want(t, 0)
+	TestingDetectorRegister(t)
+	runs++
+	want(t, runs)
+	t.Run("sub", func(t *testing.T) {
+		TestingDetectorRegister(t)
+		want(t, runs)
+	})
+	want(t, runs)
+	t.Logf("iteration %d", runs)
+}
+
+func TestIterationAfter(t *testing.T) { want(t, 0) }
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	if err := (&Generator{Iteration: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("iteration: 0\n"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out = goCmd(t, dir, "test", "-count=3", "-v", ".")
+	if want := []byte("iteration 3\n"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+}
+
+func TestOnTesting(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+var fake bool
+
+func installFakes() { fake = true }
+
+func init() { t.OnTesting(installFakes) }
+
+func main() { println("fake:", fake) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestFake(t *testing.T) {
+	if !fake {
+		t.Error("fake = false, want true")
+	}
+	var ran bool
+	(&testingDetector{}).OnTesting(func() { ran = true })
+	if !ran {
+		t.Error("OnTesting did not run a function registered after init")
+	}
+	if !late {
+		t.Error("OnTesting did not run a function registered by the " +
+			"init of a test file named after the generated one")
+	}
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	// Its init runs after the generated test file's.
+	writeFile(t, dir, "zz_test.go", []byte(`package main
+
+var late bool
+
+func init() { t.OnTesting(func() { late = true }) }
+`))
+	modInit(t, dir)
+	if err := (&Generator{OnTesting: true}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("fake: false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", ".")
+	bin := filepath.Join(t.TempDir(), exe("out"))
+	goCmd(t, dir, "build", "-o", bin, ".")
+	out = goCmd(t, dir, "tool", "nm", bin)
+	if sym := []byte("main.installFakes"); bytes.Contains(out, sym) {
+		t.Errorf("program binary contains %s", sym)
+	}
+}
+
+func TestStub(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(tt *testing.T) {
+	want := os.Getenv("WANT") == "true"
+	if got := t.Testing(); got != want {
+		tt.Errorf("t.Testing() = %t, want %t", got, want)
+	}
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	stub := &Generator{Stub: true}
+	if err := stub.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	testPath := filepath.Join(dir, "testing_detector_test.go")
+	if _, err := os.Stat(testPath); err == nil {
+		t.Errorf("stub Generate(%q) wrote %s", dir, testPath)
+	}
+	goCmd(t, dir, "vet", ".")
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("t.Testing() = false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	t.Setenv("WANT", "false")
+	goCmd(t, dir, "test", "-count=1", ".")
+
+	// Generating for real replaces the stub, and stubbing again undoes it.
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	t.Setenv("WANT", "true")
+	goCmd(t, dir, "test", "-count=1", ".")
+	if err := stub.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if _, err := os.Stat(testPath); err == nil {
+		t.Errorf("stub Generate(%q) left %s", dir, testPath)
+	}
+	t.Setenv("WANT", "false")
+	goCmd(t, dir, "test", "-count=1", ".")
+}
+
+// generateVariants generates into a package for each representative
+// combination of options, and returns the module directory and the
+// contents of the generated files by path.
+func generateVariants(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	all := Generator{
+		Benchmarking: true,
+		Fuzzing:      true,
+		Coverage:     true,
+		Race:         true,
+		Sanitizer:    true,
+		CoverExclude: true,
+		Short:        true,
+		Verbose:      true,
+		RunFilter:    true,
+		TestName:     true,
+		Iteration:    true,
+		TestPath:     true,
+		OnTesting:    true,
+
+		DirectlyTested:   true,
+		CleanupOnTesting: true,
+		OnTestingContext: true,
+		Expvar:           true,
+	}
+	pkgs := []struct {
+		name string
+		g    Generator
+	}{
+		{"main", Generator{}},
+		{"main", all},
+		{"lib", all},
+		{"main", Generator{Mode: ModeBuildTag}},
+		{"main", Generator{Backing: BackingFunc}},
+		{"lib", Generator{Backing: BackingFunc, CoverExclude: true}},
+		{"main", Generator{Mode: ModeBuildTag, CoverExclude: true}},
+		{"main", Generator{GoVersion: "go1.20"}},
+		{"lib", Generator{GoVersion: "go1.20"}},
+		{"main", Generator{Tamper: TamperLog}},
+		{"main", Generator{Tamper: TamperLog, GoVersion: "go1.20"}},
+		{"main", Generator{ModeMethod: true, Assert: true}},
+		{"lib", Generator{ModeMethod: true, Assert: true}},
+		{"main", Generator{OffTag: true, Coverage: true, Guard: true}},
+		{"main", Generator{Extend: true}},
+		{"lib", Generator{Stub: true, OnTesting: true, TestName: true}},
+		{"lib", Generator{Guard: true, ModeMethod: true, OnTesting: true}},
+	}
+	for i, pkg := range pkgs {
+		src := fmt.Sprintf("package %s\n\nvar t testingDetector\n", pkg.name)
+		if pkg.g.Extend {
+			src += "\nfunc (t testingDetector) Testing() bool " +
+				"{ return t.testingDetectorFlag() }\n"
+		}
+		writeFile(t, dir, fmt.Sprintf("p%d/p.go", i), []byte(src))
+	}
+	modInit(t, dir)
+	generated := make(map[string][]byte)
+	for i, pkg := range pkgs {
+		pkgDir := filepath.Join(dir, fmt.Sprintf("p%d", i))
+		if err := pkg.g.Generate(pkgDir); err != nil {
+			t.Fatalf("Generate(%q) = %q, want <nil>", pkgDir, err.Error())
+		}
+		paths, err := filepath.Glob(filepath.Join(pkgDir, "testing_*.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			generated[path] = data
+		}
+	}
+	return dir, generated
+}
+
+func TestFormat(t *testing.T) {
+	dir, generated := generateVariants(t)
+	goCmd(t, dir, "fmt", "./...")
+	for path, want := range generated {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("gofmt changed %s:\n%s", path,
+				unifiedDiff(path, path, want, got))
+		}
+	}
+}
+
+func TestVet(t *testing.T) {
+	// Strict CI runs go vet over everything, generated code included, so
+	// any complaint about the generated files is a bug in the generator.
+	dir, _ := generateVariants(t)
+	goCmd(t, dir, "vet", "./...")
+	goCmd(t, dir, "vet", "-tags", OffTag, "./...")
+	goCmd(t, dir, "vet", "-tags", "testdetect", "./...")
+	goCmd(t, dir, "vet", "-tags", IgnoreTag, "./...")
+}
+
+func TestHeader(t *testing.T) {
+	// See https://go.dev/s/generatedcode.
+	generated := regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+	for _, g := range []*Generator{
+		{TestName: true},
+		{Mode: ModeBuildTag},
+		{Stub: true},
+	} {
+		files, err := g.render(&packages.Package{Name: "main"})
+		if err != nil {
+			t.Fatalf("render() = %q, want <nil>", err.Error())
+		}
+		for _, f := range files {
+			line, _, _ := bytes.Cut(f.data, []byte("\n"))
+			if !generated.Match(line) {
+				t.Errorf("%s begins with %q, want match for %s",
+					f.name, line, generated)
+			}
+			version := []byte(" " + Version() + ". ")
+			if !bytes.Contains(line, version) {
+				t.Errorf("%s header %q does not contain version %q",
+					f.name, line, Version())
+			}
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	writeFile(t, dir, "main.go", program)
+	modInit(t, dir)
+	g := &Generator{Short: true}
+	mainFile := filepath.Join(dir, "testing_detector.go")
+	testFile := filepath.Join(dir, "testing_detector_test.go")
+
+	stale, err := g.Check(dir)
+	if err != nil {
+		t.Fatalf("Check(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if want := []string{mainFile, testFile}; !slices.Equal(stale, want) {
+		t.Errorf("Check(%q) = %q before Generate, want %q", dir, stale, want)
+	}
+	if _, err := os.Stat(mainFile); err == nil {
+		t.Errorf("Check(%q) wrote %s", dir, mainFile)
+	}
+
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if stale, err := g.Check(dir); err != nil {
+		t.Fatalf("Check(%q) = %q, want <nil>", dir, err.Error())
+	} else if len(stale) > 0 {
+		t.Errorf("Check(%q) = %q after Generate, want none", dir, stale)
+	}
+
+	stale, err = (&Generator{}).Check(dir)
+	if err != nil {
+		t.Fatalf("Check(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if want := []string{mainFile, testFile}; !slices.Equal(stale, want) {
+		t.Errorf("Check(%q) = %q with other options, want %q",
+			dir, stale, want)
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	writeFile(t, dir, "main.go", program)
+	modInit(t, dir)
+
+	var buf bytes.Buffer
+	if err := (&Generator{Log: &buf}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, want := range []string{
+		`variables: ["t"]`,
+		"create " + filepath.Join(dir, "testing_detector.go") + "\n",
+		"create " + filepath.Join(dir, "testing_detector_test.go") + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log did not contain %q\n%s", want, &buf)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	writeFile(t, dir, "main.go", program)
+	modInit(t, dir)
+
+	var buf bytes.Buffer
+	g := &Generator{CacheDir: t.TempDir(), Log: &buf}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if !strings.Contains(buf.String(), "type-check") {
+		t.Errorf("cold Generate(%q) did not type-check\n%s", dir, &buf)
+	}
+
+	buf.Reset()
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if strings.Contains(buf.String(), "type-check") {
+		t.Errorf("warm Generate(%q) type-checked\n%s", dir, &buf)
+	}
+	want := `cached, uses testingDetector: true, variables: ["t"]`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("log did not contain %q\n%s", want, &buf)
+	}
+	mainFile := filepath.Join(dir, "testing_detector.go")
+	if err := os.Remove(mainFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if _, err := os.Stat(mainFile); err != nil {
+		t.Errorf("warm Generate(%q) did not restore deleted file: %s",
+			dir, err)
+	}
+
+	buf.Reset()
+	edited := append(program, "\nvar u testingDetector\n"...)
+	writeFile(t, dir, "main.go", edited)
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if !strings.Contains(buf.String(), "type-check") {
+		t.Errorf("Generate(%q) after edit did not type-check\n%s",
+			dir, &buf)
+	}
+}
+
+func TestCacheDevelBuild(t *testing.T) {
+	if !localBuild(Version()) {
+		t.Skip("not a local build")
+	}
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`))
+	modInit(t, dir)
+
+	var buf bytes.Buffer
+	g := &Generator{CacheDir: t.TempDir(), Log: &buf}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	hash := executableHash
+	t.Cleanup(func() { executableHash = hash })
+	executableHash = func() (string, error) { return "rebuilt", nil }
+
+	buf.Reset()
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if !strings.Contains(buf.String(), "type-check") {
+		t.Errorf("Generate(%q) by another devel build did not type-check"+
+			"\n%s", dir, &buf)
+	}
+}
+
+func TestLocalBuild(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		want    bool
+	}{
+		{"devel", true},
+		{"v0.0.0-20250101000000-0123456789ab", true},
+		{"v1.2.4-0.20250101000000-0123456789ab", true},
+		{"v0.0.0-20250101000000-0123456789ab+dirty", true},
+		{"v1.2.3+dirty", true},
+		{"v1.2.3", false},
+		{"v1.2.3-rc.1", false},
+	} {
+		if got := localBuild(tt.version); got != tt.want {
+			t.Errorf("localBuild(%q) = %t, want %t", tt.version, got,
+				tt.want)
+		}
+	}
+}
+
+func TestCacheCompiler(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`))
+	modInit(t, dir)
+
+	cache := t.TempDir()
+	if err := (&Generator{CacheDir: cache}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	// Generation only looks at the name, so gccgo need not be installed.
+	g := &Generator{
+		CacheDir: cache,
+		Compiler: filepath.Join(t.TempDir(), "gccgo"),
+	}
+	err := g.Generate(dir)
+	if err == nil || !strings.Contains(err.Error(), "testing.Testing") {
+		t.Errorf("Generate(%q) under gccgo = %v, want testing.Testing error",
+			dir, err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+type fake struct{}
+
+func (fake) Testing() bool { return false }
+
+var t testingDetector
+
+func shadowed() bool {
+	t := fake{}
+	return t.Testing()
+}
+
+func local() bool {
+	t := new(testingDetector)
+	return t.Testing()
+}
+
+func main() { println(t.Testing(), shadowed(), local()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`))
+	modInit(t, dir)
+	warnings, err := new(Generator).Lint(dir)
+	if err != nil {
+		t.Fatalf("Lint(%q) = %q, want <nil>", dir, err.Error())
+	}
+	want := []string{filepath.Join(dir, "main.go") + ":11:9: " +
+		"t.Testing() is called on a local fake, " +
+		"which shadows the package-level testingDetector t"}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("Lint(%q) = %q, want %q", dir, warnings, want)
+	}
+	mainFile := filepath.Join(dir, "testing_detector.go")
+	if _, err := os.Stat(mainFile); err == nil {
+		t.Errorf("Lint(%q) wrote %s", dir, mainFile)
+	}
+}
+
+func TestLintUnused(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var (
+	t      testingDetector
+	unused testingDetector
+	inTest testingDetector
+)
+
+func main() { println(t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) {
+	if !inTest.Testing() {
+		t.Fatal("not testing")
+	}
+}
+`)
+	writeFile(t, dir, "main_test.go", tests)
+	modInit(t, dir)
+	warnings, err := new(Generator).Lint(dir)
+	if err != nil {
+		t.Fatalf("Lint(%q) = %q, want <nil>", dir, err.Error())
+	}
+	want := []string{filepath.Join(dir, "main.go") + ":5:2: " +
+		"testingDetector unused is declared but never used"}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("Lint(%q) = %q, want %q", dir, warnings, want)
+	}
+}
+
+func TestLintUntested(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println(t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	modInit(t, dir)
+	g := new(Generator)
+	// The generated test file does not count as a test file.
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	warnings, err := g.Lint(dir)
+	if err != nil {
+		t.Fatalf("Lint(%q) = %q, want <nil>", dir, err.Error())
+	}
+	want := []string{filepath.Join(dir, "main.go") + ":3:5: " +
+		"package example.com/pkg has no test files, so Testing() never " +
+		"reports true; add tests or remove the detector"}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("Lint(%q) = %q, want %q", dir, warnings, want)
+	}
+	writeFile(t, dir, "main_test.go", []byte(`package main_test
+`))
+	warnings, err = g.Lint(dir)
+	if err != nil {
+		t.Fatalf("Lint(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if len(warnings) > 0 {
+		t.Errorf("Lint(%q) with a test file = %q, want none", dir, warnings)
+	}
+}
+
+func TestTypeAlias(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+type td = testingDetector
+
+var t td
+
+func main() { println("testing:", t.Testing()) }
+`))
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(tt *testing.T) {
+	if !t.Testing() {
+		tt.Error("Testing() = false, want true")
+	}
+}
+`))
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	out := goCmd(t, dir, "run", ".")
+	if want := []byte("testing: false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	goCmd(t, dir, "test", "-count=1", ".")
+	detectors, err := Scan(dir)
+	if err != nil {
+		t.Fatalf("Scan(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if len(detectors) != 1 || detectors[0].Var != "t" {
+		t.Errorf("Scan(%q) = %+v, want t", dir, detectors)
+	}
+
+	writeFile(t, dir, "tamper.go", []byte(`package main
+
+func (td) Testing() bool { return true }
+`))
+	if err := Generate(dir); !errors.Is(err, ErrTamper) {
+		t.Errorf("Generate(%q) = %v, want ErrTamper", dir, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println(t.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	modInit(t, dir)
+	detectors, err := Scan(dir)
+	if err != nil {
+		t.Fatalf("Scan(%q) = %q, want <nil>", dir, err.Error())
+	}
+	want := []Detector{{
+		Type:       "testingDetector",
+		Var:        "t",
+		ImportPath: "example.com/pkg",
+		Pos: token.Position{
+			Filename: filepath.Join(dir, "main.go"),
+			Offset:   18,
+			Line:     3,
+			Column:   5,
+		},
+	}}
+	if !slices.Equal(detectors, want) {
+		t.Errorf("Scan(%q) = %+v, want %+v", dir, detectors, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "main.go" && e.Name() != "go.mod" {
+			t.Errorf("Scan(%q) wrote %s", dir, e.Name())
+		}
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	dir := t.TempDir()
+	crlf := func(s string) []byte {
+		return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+	}
+	writeFile(t, dir, "main.go", crlf(`//go:build linux || darwin
+
+package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`))
+	writeFile(t, dir, "main_test.go", crlf(`//go:build linux || darwin
+
+package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`))
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	goCmd(t, dir, "test", ".")
+
+	// Simulate a checkout that converted the generated files to CRLF.
+	var converted []string
+	for _, name := range []string{
+		"testing_detector.go",
+		"testing_detector_test.go",
+	} {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("\r")) {
+			t.Errorf("%s contains CR", name)
+		}
+		if !bytes.Contains(data, []byte("//go:build linux || darwin\n")) {
+			t.Errorf("%s does not carry the package's build constraint",
+				name)
+		}
+		data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+		writeFile(t, dir, name, data)
+		converted = append(converted, string(data))
+	}
+	g := &Generator{Report: new(Report)}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, f := range g.Report.Files {
+		if f.Action != "unchanged" {
+			t.Errorf("Generate(%q) action for %s = %q, want unchanged",
+				dir, f.Path, f.Action)
+		}
+	}
+	for i, name := range []string{
+		"testing_detector.go",
+		"testing_detector_test.go",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != converted[i] {
+			t.Errorf("Generate(%q) rewrote %s", dir, name)
+		}
+	}
+	if stale, err := new(Generator).Check(dir); err != nil {
+		t.Fatalf("Check(%q) = %q, want <nil>", dir, err.Error())
+	} else if len(stale) > 0 {
+		t.Errorf("Check(%q) = %q, want none", dir, stale)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	for _, tt := range []struct {
+		name   string
+		method string
+		want   string // Error, if not empty.
+	}{{
+		name: "correct",
+		method: `func (t testingDetector) Testing() bool {
+	return t.testingDetectorFlag() && os.Getenv("NO_TESTING") == ""
+}`,
+	}, {
+		name: "constant",
+		method: `func (t testingDetector) Testing() bool {
+	return os.Getenv("NO_TESTING") == ""
+}`,
+		want: "does not call testingDetector.testingDetectorFlag",
+	}, {
+		name: "embedded",
+		method: `func (t testingDetector) Testing() bool {
+	return t.testingDetectorEmbed.testingDetectorFlag() && os.Args != nil
+}`,
+		want: "does not call testingDetector.testingDetectorFlag",
+	}, {
+		name:   "missing",
+		method: `var _ = os.Args`,
+		want:   "testingDetector has no Testing method",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "main.go", []byte(`package main
+
+import "os"
+
+var t testingDetector
+
+`+tt.method+`
+
+func main() { println("t.Testing() =", t.Testing()) }
+`))
+			writeFile(t, dir, "main_test.go", tests)
+			modInit(t, dir)
+			err := (&Generator{Extend: true}).Generate(dir)
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("Generate(%q) = %v, want error containing %q",
+						dir, err, tt.want)
+				}
+				tamper := strings.HasPrefix(tt.want, "does not call")
+				if got := errors.Is(err, ErrTamper); got != tamper {
+					t.Errorf("errors.Is(%q, ErrTamper) = %t, want %t",
+						err, got, tamper)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+			}
+			out := goCmd(t, dir, "run", ".")
+			want := []byte("t.Testing() = false")
+			if !bytes.Contains(out, want) {
+				t.Errorf("go run output did not contain %q\n%s", want, out)
+			}
+			out = goCmd(t, dir, "test", "-count=1", "-v", ".")
+			if want := []byte("t.Testing() = true"); !bytes.Contains(
+				out, want,
+			) {
+				t.Errorf("go test output did not contain %q\n%s", want, out)
+			}
+		})
+	}
+}
+
+func TestExtendEditedLater(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`))
+	writeFile(t, dir, "testing.go", []byte(`package main
+
+func (t testingDetector) Testing() bool { return t.testingDetectorFlag() }
+`))
+	modInit(t, dir)
+	g := &Generator{Extend: true}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+
+	// Removing the method fails the build even where nothing calls it.
+	writeFile(t, dir, "main.go", []byte(`package main
+
+func main() {}
+`))
+	if err := os.Remove(filepath.Join(dir, "testing.go")); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "build", "-o", os.DevNull, ".")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatal("go build succeeded without the Testing method")
+	}
+	want := []byte("testing_detector.go")
+	if !bytes.Contains(out, want) || !bytes.Contains(out, []byte("Testing")) {
+		t.Errorf("go build output did not name %s and Testing\n%s",
+			want, out)
+	}
+
+	// The type system cannot tell that a method added later no longer
+	// calls the flag, so Check reports it instead.
+	writeFile(t, dir, "testing.go", []byte(`package main
+
+func (t testingDetector) Testing() bool { return false }
+`))
+	goCmd(t, dir, "build", "-o", os.DevNull, ".")
+	_, err = g.Check(dir)
+	if !errors.Is(err, ErrTamper) {
+		t.Fatalf("Check(%q) = %v, want %q", dir, err, ErrTamper)
+	}
+}
+
+func TestNoModule(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`))
+	err := Generate(dir)
+	if !errors.Is(err, ErrNoModule) {
+		t.Fatalf("Generate() = %v, want %q", err, ErrNoModule)
+	}
+	if !strings.Contains(err.Error(), "go mod init") {
+		t.Errorf("Generate() = %q, want mention of go mod init", err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "testing_detector.go"))
+	if err == nil {
+		t.Error("testing_detector.go written outside of a module")
+	}
+}
+
+func TestWriteInterrupted(t *testing.T) {
+	write := writeTemp
+	t.Cleanup(func() { writeTemp = write })
+	writeTemp = func(f *os.File, data []byte) error {
+		if _, err := f.Write(data[:len(data)/2]); err != nil {
+			return err
+		}
+		return errors.New("disk full")
+	}
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`))
+	modInit(t, dir)
+	path := filepath.Join(dir, "testing_detector.go")
+	old := []byte(`// Code generated by lesiw.io/testdetect. DO NOT EDIT.
+
+package main
+
+type testingDetector struct{ testingDetectorEmbed }
+type testingDetectorEmbed struct{}
+
+func (t testingDetectorEmbed) Testing() bool { return false }
+`)
+	for _, tt := range []struct {
+		name string
+		old  []byte
+	}{
+		{"create", nil},
+		{"overwrite", old},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.old != nil {
+				writeFile(t, dir, "testing_detector.go", tt.old)
+			}
+			err := (&Generator{}).Generate(dir)
+			if err == nil || !strings.Contains(err.Error(), "disk full") {
+				t.Fatalf("Generate(%q) = %v, want disk full error", dir, err)
+			}
+			data, err := os.ReadFile(path)
+			switch {
+			case tt.old == nil && !errors.Is(err, fs.ErrNotExist):
+				t.Errorf("%s exists after failed write: %v", path, err)
+			case tt.old != nil && err != nil:
+				t.Fatal(err)
+			case tt.old != nil && !bytes.Equal(data, tt.old):
+				t.Errorf("%s = %q, want %q", path, data, tt.old)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasSuffix(e.Name(), ".tmp") {
+					t.Errorf("temporary file %s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	// Files as written by releases before headers carried a version, and
+	// by a tagged release.
+	for _, tt := range []struct {
+		name    string
+		header  string
+		version string
+	}{
+		{"unversioned", "lesiw.io/testdetect.", "unversioned"},
+		{"versioned", "lesiw.io/testdetect v0.1.0.", "v0.1.0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`))
+			old := "// Code generated by " + tt.header + " DO NOT EDIT.\n"
+			writeFile(t, dir, "testing_detector.go", []byte(old+`package main
+
+type testingDetector struct{ testingDetectorEmbed }
+type testingDetectorEmbed struct{}
+
+func (t testingDetectorEmbed) Testing() bool { return false }
+`))
+			modInit(t, dir)
+			var buf bytes.Buffer
+			err := (&Generator{Log: &buf}).Generate(dir)
+			if err != nil {
+				t.Fatalf("Generate(%q) = %q, want <nil>", dir, err)
+			}
+			path := filepath.Join(dir, "testing_detector.go")
+			want := "migrate " + path + " from " + tt.version + "\n"
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("log did not contain %q\n%s", want, &buf)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := headerVersion(data); v != Version() {
+				t.Errorf("header version = %q, want %q", v, Version())
+			}
+			goCmd(t, dir, "test", ".")
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	writeFile(t, dir, "main.go", program)
+	modInit(t, dir)
+	mainFile := filepath.Join(dir, "testing_detector.go")
+
+	var buf bytes.Buffer
+	if err := (&Generator{DryRun: &buf}).Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if _, err := os.Stat(mainFile); err == nil {
+		t.Errorf("dry run Generate(%q) wrote %s", dir, mainFile)
+	}
+	for _, want := range []string{
+		"create " + mainFile + "\n--- " + os.DevNull + "\n+++ " + mainFile,
+		"+package main\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("dry run output did not contain %q\n%s", want, &buf)
+		}
+	}
+
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	before, err := os.ReadFile(mainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	g := &Generator{Short: true, DryRun: &buf}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if after, err := os.ReadFile(mainFile); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(before, after) {
+		t.Errorf("dry run Generate(%q) modified %s", dir, mainFile)
+	}
+	for _, want := range []string{
+		"overwrite " + mainFile + "\n--- " + mainFile + "\n+++ " + mainFile,
+		"\n+func (t testingDetectorEmbed) Short() bool",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("dry run output did not contain %q\n%s", want, &buf)
+		}
+	}
+}
+
+func TestClean(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var (
+	t testingDetector
+	m buildMode
+)
+
+func main() {}
+`)
+	writeFile(t, dir, "main.go", program)
+	var other = []byte(`// Code generated by stringer; DO NOT EDIT.
+
+package main
+`)
+	writeFile(t, dir, "other.go", other)
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	g := &Generator{Type: "buildMode", Mode: ModeBuildTag}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+
+	var buf bytes.Buffer
+	dry := &Generator{DryRun: &buf}
+	if _, err := dry.Clean(dir); err != nil {
+		t.Fatalf("dry run Clean(%q) = %q, want <nil>", dir, err.Error())
+	}
+	line := "remove " + filepath.Join(dir, "testing_detector.go") + "\n"
+	if !strings.Contains(buf.String(), line) {
+		t.Errorf("dry run output did not contain %q\n%s", line, &buf)
+	}
+
+	removed, err := new(Generator).Clean(dir)
+	if err != nil {
+		t.Fatalf("Clean(%q) = %q, want <nil>", dir, err.Error())
+	}
+	var want []string
+	for _, name := range []string{
+		"build_mode.go",
+		"build_mode_testdetect.go",
+		"testing_detector.go",
+		"testing_detector_test.go",
+	} {
+		want = append(want, filepath.Join(dir, name))
+	}
+	if !slices.Equal(removed, want) {
+		t.Errorf("Clean(%q) = %q, want %q", dir, removed, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if want := []string{"go.mod", "main.go", "other.go"}; !slices.Equal(
+		left, want) {
+		t.Errorf("after Clean(%q), dir has %q, want %q", dir, left, want)
+	}
+}
+
+func TestGenerateAll(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+import "example.com/pkg/tool"
+
+var t testingDetector
+
+func main() { println(t.Testing(), tool.Testing()) }
+`)
+	writeFile(t, dir, "main.go", program)
+	var tool = []byte(`package tool
+
+var t testingDetector
+
+func Testing() bool { return t.Testing() }
+`)
+	writeFile(t, dir, "tool/tool.go", tool)
+	var lib = []byte(`package lib
+
+func Lib() {}
+`)
+	writeFile(t, dir, "lib/lib.go", lib)
+	var shadow = []byte(`package shadow
+
+func Shadow() {
+	type testingDetector struct{}
+	var t testingDetector
+	_ = t
+}
+`)
+	writeFile(t, dir, "shadow/shadow.go", shadow)
+	var nested = []byte(`package nested
+
+var t testingDetector
+`)
+	writeFile(t, dir, "nested/nested.go", nested)
+	// The go command ignores these directories, and so does ./....
+	var example = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	for _, name := range []string{"testdata/example", "_old", ".hidden"} {
+		writeFile(t, dir, name+"/main.go", example)
+	}
+	modInit(t, dir)
+	goCmd(t, filepath.Join(dir, "nested"), "mod", "init", "example.com/nested")
+
+	sum, err := new(Generator).GenerateAll(dir, "./...")
+	if err != nil {
+		t.Fatalf("GenerateAll(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if got, want := sum.Generated, []string{
+		dir,
+		filepath.Join(dir, "tool"),
+	}; !slices.Equal(got, want) {
+		t.Errorf("GenerateAll(%q).Generated = %q, want %q", dir, got, want)
+	}
+	if got, want := sum.Skipped, []string{
+		filepath.Join(dir, "lib"),
+		filepath.Join(dir, "shadow"),
+	}; !slices.Equal(got, want) {
+		t.Errorf("GenerateAll(%q).Skipped = %q, want %q", dir, got, want)
+	}
+	for _, name := range []string{
+		"lib", "shadow", "nested", "testdata/example", "_old", ".hidden",
+	} {
+		path := filepath.Join(dir, name, "testing_detector.go")
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("GenerateAll(%q) wrote %s", dir, path)
+		}
+	}
+	goCmd(t, dir, "vet", "./...")
+	if stale, err := new(Generator).CheckAll(dir, "./..."); err != nil {
+		t.Fatalf("CheckAll(%q) = %q, want <nil>", dir, err.Error())
+	} else if len(stale) > 0 {
+		t.Errorf("CheckAll(%q) = %q, want none", dir, stale)
+	}
+}
+
+func TestGenerateAllConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for i := range 12 {
+		name := fmt.Sprintf("pkg%02d", i)
+		src := fmt.Sprintf("package %s\n\nvar t testingDetector\n", name)
+		if i%4 == 3 {
+			// Conflicts with the generated code, failing -verify.
+			src += "\nfunc (testingDetectorEmbed) Testing() bool " +
+				"{ return true }\n"
+		} else {
+			want = append(want, filepath.Join(dir, name))
+		}
+		writeFile(t, dir, filepath.Join(name, name+".go"), []byte(src))
+	}
+	modInit(t, dir)
+
+	var log bytes.Buffer
+	g := &Generator{Verify: true, Log: &log}
+	sum, err := g.GenerateAll(dir, "./...")
+	if err == nil {
+		t.Fatalf("GenerateAll(%q) = <nil>, want error", dir)
+	}
+	for _, name := range []string{"pkg03", "pkg07", "pkg11"} {
+		if !strings.Contains(err.Error(), filepath.Join(dir, name)) {
+			t.Errorf("GenerateAll(%q) error did not mention %s\n%s",
+				dir, name, err)
+		}
+	}
+	if !slices.Equal(sum.Generated, want) {
+		t.Errorf("GenerateAll(%q).Generated = %q, want %q",
+			dir, sum.Generated, want)
+	}
+	verbs := []string{"list", "read", "type-check", "package", "create",
+		"verify"}
+	for _, line := range strings.Split(strings.TrimSpace(log.String()),
+		"\n") {
+		verb, _, _ := strings.Cut(line, " ")
+		if !slices.Contains(verbs, verb) {
+			t.Errorf("garbled log line %q", line)
+		}
+	}
+	for _, pkg := range want {
+		goCmd(t, pkg, "vet", ".")
+	}
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("could not create directory for %q: %s", path, err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func modInit(t *testing.T, dir string) {
+	t.Helper()
+	goCmd(t, dir, "mod", "init", "example.com/pkg")
+}
+
+func goCmd(t *testing.T, dir string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go %s failed: %s\n%s", args[0], err, out)
+	}
+	return out
+}
+
+func TestBuildBinaries(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("test only")
+	}
+	println("always")
+}
+`))
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`))
+	modInit(t, dir)
+	if err := Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	bin, testbin, err := BuildBinaries(dir)
+	if err != nil {
+		t.Fatalf("BuildBinaries(%q) = %q, want <nil>", dir, err.Error())
+	}
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		s        string
+		contains bool
+	}{
+		{"program", bin, "always", true},
+		{"program", bin, "test only", false},
+		{"test", testbin, "test only", true},
+	} {
+		if got := bytes.Contains(tt.data, []byte(tt.s)); got != tt.contains {
+			t.Errorf("%s binary contains %q = %t, want %t",
+				tt.name, tt.s, got, tt.contains)
+		}
+	}
+	writeFile(t, dir, "main.go", []byte("package main\n\nfunc main() {\n"))
+	if _, _, err := BuildBinaries(dir); !errors.Is(err, ErrBuild) {
+		t.Errorf("BuildBinaries(%q) = %v, want ErrBuild", dir, err)
+	}
+}
+
+func TestImportOrder(t *testing.T) {
+	g := &Generator{Race: true, Coverage: true, ModeMethod: true, Short: true}
+	dir := t.TempDir()
+	modInit(t, dir)
+	var generated [2]map[string][]byte
+	for i, imports := range []string{
+		"import (\n\t\"fmt\"\n\t\"os\"\n\t\"testing\"\n)",
+		"import \"testing\"\n\nimport (\n\t\"os\"\n\n\t\"fmt\"\n)",
+	} {
+		writeFile(t, dir, "main.go", []byte(`package main
+
+`+imports+`
+
+var t testingDetector
+
+func main() { fmt.Fprintln(os.Stdout, t.Testing(), testing.Short) }
+`))
+		if err := g.Generate(dir); err != nil {
+			t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+		}
+		generated[i] = make(map[string][]byte)
+		for _, name := range []string{
+			"testing_detector.go", "testing_detector_test.go",
+		} {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			generated[i][name] = data
+		}
+	}
+	for name, want := range generated[0] {
+		if got := generated[1][name]; !bytes.Equal(got, want) {
+			t.Errorf("%s changed when main.go reordered its imports:\n%s",
+				name, unifiedDiff("before", "after", want, got))
+		}
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	g := &Generator{Race: true, Coverage: true, ModeMethod: true}
+	var bins, srcs [2][]byte
+	for i := range bins {
+		// Different directories, so that any path embedded in the binary
+		// makes the two differ.
+		dir := t.TempDir()
+		writeFile(t, dir, "main.go", []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("test only")
+	}
+	println(t.Race(), t.Coverage(), t.Mode().Testing)
+}
+`))
+		modInit(t, dir)
+		if err := g.Generate(dir); err != nil {
+			t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+		}
+		src, err := os.ReadFile(filepath.Join(dir, "testing_detector.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs[i] = src
+		out := filepath.Join(t.TempDir(), "out")
+		goCmd(t, dir, "build", "-trimpath", "-o", out, ".")
+		bin, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(bin, []byte(dir)) {
+			t.Errorf("program binary contains its directory %q", dir)
+		}
+		bins[i] = bin
+	}
+	if !bytes.Equal(srcs[0], srcs[1]) {
+		t.Errorf("generated files differ between directories")
+	}
+	if !bytes.Equal(bins[0], bins[1]) {
+		t.Errorf("program binaries built with -trimpath differ")
+	}
+}
+
+func TestCgo(t *testing.T) {
+	t.Setenv("CGO_ENABLED", "1")
+	cc := strings.Fields(string(goCmd(t, ".", "env", "CC")))
+	if len(cc) == 0 {
+		t.Skip("no C compiler configured")
+	} else if _, err := exec.LookPath(cc[0]); err != nil {
+		t.Skipf("C compiler %s not installed", cc[0])
+	}
+	dir := t.TempDir()
+	writeFile(t, dir, "main.go", []byte(`package main
+
+// static int answer(void) { return 42; }
+import "C"
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("test only")
+	}
+	println("answer:", int(C.answer()))
+}
+`))
+	writeFile(t, dir, "main_test.go", []byte(`package main
+
+import "testing"
+
+func TestMain(tt *testing.T) {
+	if !t.Testing() {
+		tt.Error("Testing() = false, want true")
+	}
+	main()
+}
+`))
+	modInit(t, dir)
+	g := &Generator{NoTamper: true, Verify: true, AssertNoTesting: true}
+	if err := g.Generate(dir); err != nil {
+		t.Fatalf("Generate(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if stale, err := g.Check(dir); err != nil {
+		t.Fatalf("Check(%q) = %q, want <nil>", dir, err.Error())
+	} else if len(stale) > 0 {
+		t.Errorf("Check(%q) = %q, want none", dir, stale)
+	}
+	goCmd(t, dir, "test", "-count=1", ".")
+	bin, testbin, err := BuildBinaries(dir)
+	if err != nil {
+		t.Fatalf("BuildBinaries(%q) = %q, want <nil>", dir, err.Error())
+	}
+	if bytes.Contains(bin, []byte("test only")) {
+		t.Error("program binary contains test-only code")
+	}
+	if !bytes.Contains(testbin, []byte("test only")) {
+		t.Error("test binary does not contain test-only code")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	kinds := []error{
+		ErrNoDetector, ErrTamper, ErrConflict, ErrBuild, ErrNoModule,
+		ErrSyntax,
+	}
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		run   func(dir string) error
+		want  error
+	}{{
+		name: "no detector",
+		files: map[string]string{"main.go": `package main
+
+func main() {}
+`},
+		run: func(dir string) error {
+			_, err := new(Generator).Size(dir)
+			return err
+		},
+		want: ErrNoDetector,
+	}, {
+		name: "misspelled detector",
+		files: map[string]string{"main.go": `package main
+
+var t testingDetecter
+
+func main() {}
+`},
+		run:  Generate,
+		want: ErrNoDetector,
+	}, {
+		name: "tamper",
+		files: map[string]string{"main.go": `package main
+
+var t testingDetector
+
+func (testingDetector) Testing() bool { return true }
+
+func main() {}
+`},
+		run:  Generate,
+		want: ErrTamper,
+	}, {
+		name: "conflict",
+		files: map[string]string{
+			"main.go": `package main
+
+var t testingDetector
+
+func main() {}
+`,
+			"testing_detector.go": "package main\n",
+		},
+		run:  Generate,
+		want: ErrConflict,
+	}, {
+		name: "build",
+		files: map[string]string{"main.go": `package main
+
+var t testingDetector
+
+func (testingDetectorEmbed) Testing() bool { return true }
+
+func main() {}
+`},
+		run:  (&Generator{Verify: true}).Generate,
+		want: ErrBuild,
+	}, {
+		name: "syntax",
+		files: map[string]string{"main.go": `package main
+
+var t testingDetector
+
+func main() {
+`},
+		run:  (&Generator{SkipInvalid: true}).Generate,
+		want: ErrSyntax,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.files {
+				writeFile(t, dir, name, []byte(data))
+			}
+			modInit(t, dir)
+			err := tt.run(dir)
+			if err == nil {
+				t.Fatalf("err = <nil>, want %q", tt.want)
+			}
+			for _, kind := range kinds {
+				got, want := errors.Is(err, kind), kind == tt.want
+				if got != want {
+					t.Errorf("errors.Is(%q, %q) = %t, want %t",
+						err, kind, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package detect
+
+import (
+	"cmp"
+	"go/token"
+	"slices"
+)
+
+// A Detector describes a package-level variable that holds a detector.
+type Detector struct {
+	Type       string         // Name of the detector type.
+	Var        string         // Name of the variable.
+	ImportPath string         // Import path of the package declaring it.
+	Pos        token.Position // Position of the variable's name.
+}
+
+// Scan returns the detectors in the package in dir using the zero
+// [Generator].
+func Scan(dir string) ([]Detector, error) { return new(Generator).Scan(dir) }
+
+// Scan returns the detectors in the package in dir. See
+// [Generator.ScanAll].
+func (g *Generator) Scan(dir string) ([]Detector, error) {
+	return g.ScanAll(dir, ".")
+}
+
+// ScanAll returns the package-level variables of the detector type, or of
+// an interface type initialized with a detector, in every package matching
+// patterns, ordered by position. It parses and type-checks the packages as
+// generation would, including the detector files generation would write,
+// but does not modify anything.
+func (g *Generator) ScanAll(
+	dir string, patterns ...string,
+) (detectors []Detector, err error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	pkgs, err := g.uncached().scan(dir, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	typ := cmp.Or(g.Type, DefaultType)
+	for _, pkg := range pkgs {
+		scope := pkg.Types.Scope()
+		names := slices.Concat(
+			detectorVars(pkg.Package, typ),
+			interfaceVars(pkg.Package, typ),
+		)
+		for _, name := range names {
+			detectors = append(detectors, Detector{
+				Type:       typ,
+				Var:        name,
+				ImportPath: pkg.PkgPath,
+				Pos:        pkg.Fset.Position(scope.Lookup(name).Pos()),
+			})
+		}
+	}
+	slices.SortFunc(detectors, func(a, b Detector) int {
+		return cmp.Or(
+			cmp.Compare(a.Pos.Filename, b.Pos.Filename),
+			cmp.Compare(a.Pos.Offset, b.Pos.Offset),
+		)
+	})
+	return detectors, nil
+}
@@ -0,0 +1,122 @@
+package detect
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// An edit is one line of a line-based diff.
+type edit struct {
+	op   byte // ' ', '-', or '+'.
+	line []byte
+}
+
+// unifiedDiff returns a unified diff that turns old into new, labeling the
+// two sides oldName and newName. It returns nil if old and new are equal.
+func unifiedDiff(oldName, newName string, old, new []byte) []byte {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	edits := diffLines(splitLines(old), splitLines(new))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+
+	// pos[k] is the number of old and new lines that precede edits[k].
+	pos := make([][2]int, len(edits)+1)
+	for k, e := range edits {
+		pos[k+1] = pos[k]
+		if e.op != '+' {
+			pos[k+1][0]++
+		}
+		if e.op != '-' {
+			pos[k+1][1]++
+		}
+	}
+
+	const context = 3
+	for i := 0; i < len(edits); {
+		for i < len(edits) && edits[i].op == ' ' {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+		start, end := max(i-context, 0), i+1
+		for j := i; j < len(edits); j++ {
+			if edits[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		stop := min(end+context, len(edits))
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(pos[start][0], pos[stop][0]-pos[start][0]),
+			hunkRange(pos[start][1], pos[stop][1]-pos[start][1]),
+		)
+		for _, e := range edits[start:stop] {
+			buf.WriteByte(e.op)
+			buf.Write(e.line)
+			if !bytes.HasSuffix(e.line, []byte("\n")) {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+	return buf.Bytes()
+}
+
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+}
+
+// splitLines splits b after each newline.
+func splitLines(b []byte) [][]byte {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a minimal line diff between a and b from their longest
+// common subsequence. Generated files are small, so the quadratic table is
+// not a concern.
+func diffLines(a, b [][]byte) []edit {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if bytes.Equal(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && bytes.Equal(a[i], b[j]):
+			edits = append(edits, edit{' ', a[i]})
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+	return edits
+}
@@ -0,0 +1,48 @@
+package detect
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{{
+		name: "equal",
+		old:  "a\nb\n",
+		new:  "a\nb\n",
+		want: "",
+	}, {
+		name: "create",
+		old:  "",
+		new:  "a\nb\n",
+		want: "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+	}, {
+		name: "change",
+		old:  "a\nb\nc\nd\ne\nf\ng\nh\n",
+		new:  "a\nb\nc\nd\nE\nf\ng\nh\n",
+		want: "--- old\n+++ new\n@@ -2,7 +2,7 @@\n" +
+			" b\n c\n d\n-e\n+E\n f\n g\n h\n",
+	}, {
+		name: "hunks",
+		old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+		new:  "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n",
+		want: "--- old\n+++ new\n@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n" +
+			"@@ -9,4 +10,3 @@\n 9\n 10\n 11\n-12\n",
+	}, {
+		name: "no newline",
+		old:  "a\nb",
+		new:  "a\nb\n",
+		want: "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n" +
+			"\\ No newline at end of file\n+b\n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(unifiedDiff("old", "new",
+				[]byte(tt.old), []byte(tt.new)))
+			if got != tt.want {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
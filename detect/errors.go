@@ -0,0 +1,49 @@
+package detect
+
+import "errors"
+
+// Errors returned by the [Generator] methods wrap one of these, so callers
+// can tell failures apart with [errors.Is]. The wrapping errors keep their
+// own messages, which name the files and packages involved.
+var (
+	// ErrNoDetector reports a package that does not use the detector type
+	// passed to [Generator.Generate] or [Generator.Size].
+	ErrNoDetector = errors.New("package does not use the detector")
+
+	// ErrTamper reports a hand-written method that overrides a generated
+	// detector method, which the tamper check would panic on, or, with
+	// [Generator.Extend], a detector method that ignores the flag method.
+	ErrTamper = errors.New("detector method overridden")
+
+	// ErrConflict reports an existing file that the generator would have to
+	// overwrite but did not write.
+	ErrConflict = errors.New("file not generated by testdetect")
+
+	// ErrBuild reports a go command that failed, or a program binary that
+	// failed [Generator.AssertNoTesting].
+	ErrBuild = errors.New("build failed")
+
+	// ErrNoModule reports a directory outside of any Go module, in which
+	// packages cannot be loaded.
+	ErrNoModule = errors.New("not in a Go module")
+
+	// ErrOption reports options of a [Generator] that are invalid, such as
+	// a type name that is not an identifier, or that cannot be combined.
+	ErrOption = errors.New("bad options")
+
+	// ErrSyntax reports a package with a source file that does not parse,
+	// such as one in the middle of being edited.
+	ErrSyntax = errors.New("syntax error")
+)
+
+// kindError adds kind to the chain of err without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func withKind(kind, err error) error { return &kindError{kind, err} }
+
+func (e *kindError) Error() string { return e.err.Error() }
+
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
@@ -0,0 +1,92 @@
+package detect
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"text/template"
+
+	"golang.org/x/tools/go/packages"
+)
+
+//nolint:lll
+var testingDetectorHook = template.Must(template.New("").Parse(`// Code generated by lesiw.io/testdetect {{.Version}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import {{.Helper}}Pkg "{{.Import}}"
+
+// Make {{.Helper}}Pkg.{{.Export}} report true in this package's test binary.
+func init() { {{.Helper}}Pkg.{{.Hook}} = true }
+`))
+
+type hookData struct {
+	Version string
+	Package string
+	Helper  string
+	Import  string
+	Export  string
+	Hook    string
+}
+
+// caller returns the package in dir that imports the subpackage, or nil if
+// dir has no Go files yet.
+func caller(dir string) (*packages.Package, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not read %s: %w", dir, err)
+	}
+	if !slices.ContainsFunc(entries, func(e fs.DirEntry) bool {
+		return !e.IsDir() && filepath.Ext(e.Name()) == ".go"
+	}) {
+		return nil, nil
+	}
+	pkgs, err := loadPackages(dir, nil, ".")
+	if err != nil {
+		return nil, err
+	}
+	return pkgs[0], nil
+}
+
+// renderHook returns the _test.go file for pkg, the package in dir, that
+// sets the hook of g's subpackage, so that the subpackage's detector reports
+// true in pkg's test binary without linking the testing package into
+// program binaries. The file is named relative to the subpackage. There is
+// none in [ModeBuildTag], whose detector does not need it, or if pkg is nil.
+func (g *Generator) renderHook(
+	dir string, pkg *packages.Package,
+) (f file, ok bool, err error) {
+	if pkg == nil || g.Mode == ModeBuildTag {
+		return file{}, false, nil
+	}
+	typ := cmp.Or(g.Type, DefaultType)
+	data := hookData{
+		Version: Version(),
+		Package: pkg.Name,
+		Helper:  unexported(typ),
+		Import:  path.Join(pkg.PkgPath, filepath.ToSlash(g.Subpackage)),
+		Export:  cmp.Or(g.Method, DefaultMethod),
+		Hook:    exported(typ) + "Hook",
+	}
+	var buf bytes.Buffer
+	if err := testingDetectorHook.Execute(&buf, data); err != nil {
+		return file{}, false, fmt.Errorf("could not generate hook: %w", err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return file{}, false, fmt.Errorf("could not format hook: %w", err)
+	}
+	name, err := filepath.Rel(filepath.Join(dir, g.Subpackage),
+		filepath.Join(dir, g.base()+"_hook_test.go"))
+	if err != nil {
+		return file{}, false, err
+	}
+	return file{name, src}, true, nil
+}
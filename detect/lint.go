@@ -0,0 +1,200 @@
+package detect
+
+import (
+	"cmp"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Lint reports calls in the package in dir that look like calls to the
+// detector but are not. See [Generator.LintAll].
+func (g *Generator) Lint(dir string) (warnings []string, err error) {
+	return g.LintAll(dir, ".")
+}
+
+// LintAll reports calls to a detector method, in every package matching
+// patterns, whose receiver is named after a package-level detector variable
+// but is actually a local variable of another type that shadows it. Such a
+// call compiles whenever the other type happens to have a method of the
+// same name, and silently stops detecting anything. It also reports
+// package-level detector variables that nothing refers to, not even the
+// package's tests, which leave the generated files as dead code, and
+// packages with detector variables but no test files of their own, whose
+// detector method never reports true. Each warning starts with the
+// file:line:column of the call or declaration. It does not modify anything.
+func (g *Generator) LintAll(
+	dir string, patterns ...string,
+) (warnings []string, err error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	pkgs, err := g.uncached().scan(dir, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	typ := cmp.Or(g.Type, DefaultType)
+	method := cmp.Or(g.Method, DefaultMethod)
+	names := append(g.methods(), method)
+	own := make(map[string]bool)
+	for _, pkg := range pkgs {
+		for _, f := range pkg.files {
+			own[f.name] = true
+		}
+	}
+	for _, pkg := range pkgs {
+		if !pkg.uses {
+			continue
+		}
+		warnings = append(warnings,
+			shadowedCalls(pkg.Package, typ, names, own)...)
+		unused, err := unusedVars(pkg, typ, names, own)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, unused...)
+		warning, err := untested(pkg, typ, method, own)
+		if err != nil {
+			return nil, err
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings, nil
+}
+
+// untested reports, at its first detector variable, whether pkg has no test
+// files other than those whose base names are in own.
+func untested(
+	pkg scannedPackage, typ, method string, own map[string]bool,
+) (warning string, err error) {
+	vars := detectorVars(pkg.Package, typ)
+	if len(vars) == 0 {
+		return "", nil
+	}
+	entries, err := os.ReadDir(pkg.dir)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", pkg.dir, err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasSuffix(name, "_test.go") && !own[name] {
+			return "", nil
+		}
+	}
+	obj := pkg.Types.Scope().Lookup(vars[0])
+	return fmt.Sprintf("%s: package %s has no test files, so %s() "+
+		"never reports true; add tests or remove the detector",
+		pkg.Fset.Position(obj.Pos()), pkg.PkgPath, method), nil
+}
+
+// unusedVars reports the package-level detector variables in pkg that are
+// never referred to. The scan does not type-check test files, so they are
+// searched for calls to the methods in names on a variable of the same name
+// instead; test functions conventionally call their *testing.T t as well.
+// Files whose base names are in own are skipped.
+func unusedVars(
+	pkg scannedPackage, typ string, names []string, own map[string]bool,
+) (warnings []string, err error) {
+	used := make(map[string]bool)
+	for id, obj := range pkg.TypesInfo.Uses {
+		file := pkg.Fset.File(id.Pos()).Name()
+		if !own[filepath.Base(file)] && obj.Parent() == pkg.Types.Scope() {
+			used[obj.Name()] = true
+		}
+	}
+	entries, err := os.ReadDir(pkg.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", pkg.dir, err)
+	}
+	fset := token.NewFileSet()
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, "_test.go") || own[name] {
+			continue
+		}
+		path := filepath.Join(pkg.dir, name)
+		f, err := parser.ParseFile(fset, path, nil,
+			parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok || !slices.Contains(names, sel.Sel.Name) {
+				return true
+			}
+			if id, ok := sel.X.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+			return true
+		})
+	}
+	scope := pkg.Types.Scope()
+	for _, name := range detectorVars(pkg.Package, typ) {
+		if used[name] {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf(
+			"%s: %s %s is declared but never used",
+			pkg.Fset.Position(scope.Lookup(name).Pos()), typ, name))
+	}
+	return warnings, nil
+}
+
+// shadowedCalls implements [Generator.LintAll] for pkg. Files whose base
+// names are in own are skipped.
+func shadowedCalls(
+	pkg *packages.Package, typ string, names []string, own map[string]bool,
+) (warnings []string) {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return nil
+	}
+	vars := detectorVars(pkg, typ)
+	for _, f := range pkg.Syntax {
+		file := pkg.Fset.File(f.Pos()).Name()
+		if own[filepath.Base(file)] {
+			continue
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || !slices.Contains(names, sel.Sel.Name) {
+				return true
+			}
+			id, ok := sel.X.(*ast.Ident)
+			if !ok || !slices.Contains(vars, id.Name) {
+				return true
+			}
+			v, ok := pkg.TypesInfo.Uses[id].(*types.Var)
+			if !ok || v.Parent() == pkg.Types.Scope() {
+				return true
+			}
+			if isDetector(v.Type(), obj) {
+				return true
+			}
+			warnings = append(warnings, fmt.Sprintf(
+				"%s: %s.%s() is called on a local %s, "+
+					"which shadows the package-level %s %s",
+				pkg.Fset.Position(id.Pos()), id.Name, sel.Sel.Name,
+				types.TypeString(v.Type(), types.RelativeTo(pkg.Types)),
+				typ, id.Name,
+			))
+			return true
+		})
+	}
+	return warnings
+}
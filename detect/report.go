@@ -0,0 +1,52 @@
+package detect
+
+// A Report describes what a [Generator] did, for tools that wrap it.
+// Its JSON encoding is stable.
+type Report struct {
+	// Packages lists the packages that were scanned, in import path order.
+	Packages []ReportPackage
+
+	// Files lists the detector files that were considered, in the order
+	// they were considered. Files in different packages may be considered
+	// concurrently, so their relative order can vary from run to run.
+	Files []ReportFile
+}
+
+// A ReportPackage describes a scanned package.
+type ReportPackage struct {
+	Dir        string   // Package directory.
+	ImportPath string   // Package import path.
+	Uses       bool     // Whether the package uses the detector type.
+	Vars       []string // Package-level variables holding a detector.
+	Issues     []string // Problems that prevent generation, if any.
+}
+
+// A ReportFile describes a detector file.
+type ReportFile struct {
+	Path string
+
+	// Action is "create", "overwrite", "unchanged", or "remove" when
+	// generating or cleaning, and "stale" when checking.
+	Action string
+
+	// Written reports whether the action was carried out, rather than
+	// described by a dry run or check.
+	Written bool
+}
+
+func (g *Generator) reportPackage(p ReportPackage) {
+	if g.Report != nil {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		g.Report.Packages = append(g.Report.Packages, p)
+	}
+}
+
+func (g *Generator) reportFile(path, action string, written bool) {
+	if g.Report != nil {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		g.Report.Files = append(g.Report.Files,
+			ReportFile{Path: path, Action: action, Written: written})
+	}
+}
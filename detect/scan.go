@@ -0,0 +1,892 @@
+package detect
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// usesType reports whether pkg refers to its package-level type named typ
+// outside of the generated files. Identifiers that merely share the name,
+// such as a shadowing local declaration, do not count.
+func usesType(
+	pkg *packages.Package, typ string, generated map[string][]byte,
+) bool {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return false
+	}
+	for _, f := range pkg.Syntax {
+		if _, ok := generated[pkg.Fset.File(f.Pos()).Name()]; ok {
+			continue
+		}
+		var found bool
+		ast.Inspect(f, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && pkg.TypesInfo.Uses[id] == obj {
+				found = true
+			}
+			return !found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// declaresPointer reports whether the files of pkg, other than the test
+// files and those named after base, which the generator writes, declare a
+// package-level variable of type *typ without initializing it. Files the
+// current build context excludes count too, like in [buildConstraint].
+// The generated methods of such a detector must be safe to call through a
+// nil pointer.
+func declaresPointer(pkg *packages.Package, typ, base string) (bool, error) {
+	fset := token.NewFileSet()
+	for _, name := range slices.Concat(pkg.GoFiles, pkg.IgnoredFiles) {
+		switch filepath.Base(name) {
+		case base + ".go", base + "_testdetect.go", base + "_off.go",
+			base + "_ignore.go":
+			continue
+		}
+		if !strings.HasSuffix(name, ".go") ||
+			strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil,
+			parser.SkipObjectResolution)
+		if err != nil {
+			return false, withKind(ErrSyntax, fmt.Errorf(
+				"could not parse package %s: %w", pkg.PkgPath, err))
+		}
+		if f.Name.Name == pkg.Name && nilPointerDecl(f, typ) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nilPointerDecl is [declaresPointer] for the file f.
+func nilPointerDecl(f *ast.File, typ string) bool {
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ValueSpec)
+			ptr, ok := spec.Type.(*ast.StarExpr)
+			if !ok || len(spec.Values) > 0 {
+				continue
+			}
+			x := ptr.X
+			switch index := x.(type) {
+			case *ast.IndexExpr:
+				x = index.X
+			case *ast.IndexListExpr:
+				x = index.X
+			}
+			if id, ok := x.(*ast.Ident); ok && id.Name == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nilPointers reports the package-level variables in pkg that are declared
+// as a pointer to the detector type named typ without being initialized,
+// unless method, the detector method, is declared on the pointer type, as
+// it is when generated for such a variable. Otherwise the detector methods
+// are promoted through an embedded field, so calling them through a nil
+// pointer panics. This catches declarations that [declaresPointer] cannot
+// see without type-checking, such as through an alias of the pointer type.
+func nilPointers(
+	pkg *packages.Package, typ, method string,
+) (errs []error) {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return nil
+	}
+	ptr := types.NewPointer(obj.Type())
+	if _, index, _ := types.LookupFieldOrMethod(
+		ptr, true, pkg.Types, method,
+	); len(index) == 1 {
+		return nil
+	}
+	for _, f := range pkg.Syntax {
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.ValueSpec)
+				if len(spec.Values) > 0 {
+					continue
+				}
+				for _, name := range spec.Names {
+					v, ok := pkg.TypesInfo.Defs[name].(*types.Var)
+					if !ok {
+						continue
+					}
+					_, ok = v.Type().(*types.Pointer)
+					if !ok || !isDetector(v.Type(), obj) {
+						continue
+					}
+					errs = append(errs, fmt.Errorf(
+						"%s: var %s is a nil *%s: "+
+							"declare it as %s or initialize it with new(%s)",
+						pkg.Fset.Position(name.Pos()), name.Name,
+						typ, typ, typ,
+					))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// overrides reports methods named in names that the files of pkg, other
+// than the generated ones, declare on the detector type named typ. Such a
+// method shadows the generated one in every binary, which is exactly what
+// the tamper check in main packages panics over at run time.
+func overrides(
+	pkg *packages.Package, typ string, names []string,
+	generated map[string][]byte,
+) (errs []error) {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return nil
+	}
+	for _, f := range pkg.Syntax {
+		if _, ok := generated[pkg.Fset.File(f.Pos()).Name()]; ok {
+			continue
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || !slices.Contains(names, fn.Name.Name) {
+				continue
+			}
+			def, ok := pkg.TypesInfo.Defs[fn.Name].(*types.Func)
+			if !ok {
+				continue
+			}
+			recv := def.Type().(*types.Signature).Recv().Type()
+			if isDetector(recv, obj) {
+				errs = append(errs, withKind(ErrTamper, fmt.Errorf(
+					"%s: method %s.%s overrides the generated detector",
+					pkg.Fset.Position(fn.Name.Pos()), typ, fn.Name.Name,
+				)))
+			}
+		}
+	}
+	return errs
+}
+
+// extension reports a problem with the hand-written detector method that
+// Extend requires: it must be declared on the detector type named typ in
+// the files of pkg, other than the generated ones, and call the generated
+// flag method on its receiver. Without that call, it cannot tell test
+// binaries apart, which is what the tamper check exists to catch.
+func extension(
+	pkg *packages.Package, typ, method, flag string,
+	generated map[string][]byte,
+) []error {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return nil
+	}
+	for _, f := range pkg.Syntax {
+		if _, ok := generated[pkg.Fset.File(f.Pos()).Name()]; ok {
+			continue
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || fn.Name.Name != method ||
+				fn.Body == nil {
+				continue
+			}
+			def, ok := pkg.TypesInfo.Defs[fn.Name].(*types.Func)
+			if !ok {
+				continue
+			}
+			recv := def.Type().(*types.Signature).Recv().Type()
+			if !isDetector(recv, obj) {
+				continue
+			}
+			var reads bool
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				sel, ok := n.(*ast.SelectorExpr)
+				if !ok || sel.Sel.Name != flag {
+					return !reads
+				}
+				// Calling the flag method through the embedded field
+				// would skip the test binary's override.
+				if s, ok := pkg.TypesInfo.Selections[sel]; ok {
+					reads = isDetector(s.Recv(), obj)
+				}
+				return !reads
+			})
+			if reads {
+				return nil
+			}
+			return []error{withKind(ErrTamper, fmt.Errorf(
+				"%s: method %s.%s does not call %s.%s, "+
+					"so it cannot tell test binaries apart",
+				pkg.Fset.Position(fn.Name.Pos()), typ, method, typ, flag,
+			))}
+		}
+	}
+	return []error{fmt.Errorf("%s: %s has no %s method, which Extend requires",
+		pkg.PkgPath, typ, method)}
+}
+
+// detectorVars returns the names of the package-level variables in pkg
+// whose type is the detector type named typ or a pointer to it.
+func detectorVars(pkg *packages.Package, typ string) (names []string) {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return nil
+	}
+	scope := pkg.Types.Scope()
+	for _, name := range scope.Names() {
+		v, ok := scope.Lookup(name).(*types.Var)
+		if !ok {
+			continue
+		}
+		if isDetector(v.Type(), obj) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// interfaceVars returns the names of the package-level variables in pkg
+// of an interface type whose initializer is a value of the detector type
+// named typ or a pointer to it. Calls through them dispatch to the same
+// methods as calls on the detector itself.
+func interfaceVars(pkg *packages.Package, typ string) (names []string) {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return nil
+	}
+	for _, init := range pkg.TypesInfo.InitOrder {
+		if len(init.Lhs) != 1 || !types.IsInterface(init.Lhs[0].Type()) {
+			continue
+		}
+		t := pkg.TypesInfo.TypeOf(init.Rhs)
+		if isDetector(t, obj) && init.Lhs[0].Name() != "_" {
+			names = append(names, init.Lhs[0].Name())
+		}
+	}
+	return names
+}
+
+// isDetector reports whether t is, or points to, the detector type obj or,
+// if it is generic, an instantiation of it, possibly through a type alias.
+func isDetector(t types.Type, obj *types.TypeName) bool {
+	named := derefNamed(t)
+	return named != nil && named.Obj() == obj
+}
+
+// derefNamed returns the named type that t is or points to, looking through
+// type aliases, or nil if there is none. Methods on the detector may be
+// declared and called on either.
+func derefNamed(t types.Type) *types.Named {
+	if ptr, ok := types.Unalias(t).(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, _ := types.Unalias(t).(*types.Named)
+	return named
+}
+
+// typeArgs reports uses of the detector type named typ in the files of pkg,
+// other than the generated ones, whose number of type arguments does not
+// match params, including uses without any when params is not empty.
+// Type-checking the package reports these as well, but not in terms of the
+// generator's options.
+func typeArgs(
+	pkg *packages.Package, typ string, params []string,
+	generated map[string][]byte,
+) (errs []error) {
+	obj := detectorType(pkg, typ)
+	if obj == nil {
+		return nil
+	}
+	for _, f := range pkg.Syntax {
+		if _, ok := generated[pkg.Fset.File(f.Pos()).Name()]; ok {
+			continue
+		}
+		// The number of type arguments of each use, by identifier. An
+		// index expression is visited before the identifier it indexes.
+		args := make(map[*ast.Ident]int)
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.IndexExpr:
+				if id, ok := n.X.(*ast.Ident); ok {
+					args[id] = 1
+				}
+				return true
+			case *ast.IndexListExpr:
+				if id, ok := n.X.(*ast.Ident); ok {
+					args[id] = len(n.Indices)
+				}
+				return true
+			}
+			id, ok := n.(*ast.Ident)
+			if !ok || pkg.TypesInfo.Uses[id] != obj ||
+				args[id] == len(params) {
+				return true
+			}
+			pos := pkg.Fset.Position(id.Pos())
+			switch {
+			case len(params) == 0:
+				errs = append(errs, fmt.Errorf(
+					"%s: %s has type arguments, but TypeParams is empty",
+					pos, typ))
+			case args[id] == 0:
+				errs = append(errs, fmt.Errorf(
+					"%s: %s has no type arguments, but TypeParams has %d",
+					pos, typ, len(params)))
+			default:
+				errs = append(errs, fmt.Errorf(
+					"%s: %s has %d type arguments, but TypeParams has %d",
+					pos, typ, args[id], len(params)))
+			}
+			return true
+		})
+	}
+	return errs
+}
+
+// detectorType returns the package-level type named typ in pkg, or nil if
+// there is none.
+func detectorType(pkg *packages.Package, typ string) *types.TypeName {
+	if pkg.Types == nil {
+		return nil
+	}
+	obj, _ := pkg.Types.Scope().Lookup(typ).(*types.TypeName)
+	return obj
+}
+
+// buildConstraint returns the build constraint under which pkg uses the
+// detector type named typ, or nil if it uses it unconditionally. Every file
+// that refers to typ by name is considered, including files the current
+// build context excludes, and their constraints are combined with ||. Files
+// named after base, which the generator writes, are skipped.
+func buildConstraint(
+	pkg *packages.Package, typ, base string,
+) (constraint.Expr, error) {
+	var (
+		exprs []constraint.Expr
+		seen  = make(map[string]bool)
+	)
+	fset := token.NewFileSet()
+	for _, name := range slices.Concat(pkg.GoFiles, pkg.IgnoredFiles) {
+		switch filepath.Base(name) {
+		case base + ".go", base + "_testdetect.go", base + "_off.go",
+			base + "_ignore.go":
+			continue
+		}
+		if !strings.HasSuffix(name, ".go") ||
+			strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil,
+			parser.ParseComments|parser.SkipObjectResolution)
+		if err != nil {
+			return nil, withKind(ErrSyntax, fmt.Errorf(
+				"could not parse package %s: %w", pkg.PkgPath, err))
+		}
+		if f.Name.Name != pkg.Name || !mentions(f, typ) {
+			continue
+		}
+		expr, err := fileConstraint(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad build constraint in %s: %w",
+				name, err)
+		} else if expr == nil {
+			return nil, nil
+		}
+		if s := expr.String(); !seen[s] {
+			seen[s] = true
+			exprs = append(exprs, expr)
+		}
+	}
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	expr := exprs[0]
+	for _, x := range exprs[1:] {
+		expr = &constraint.OrExpr{X: expr, Y: x}
+	}
+	return expr, nil
+}
+
+// fileConstraint returns the //go:build constraint of f, or nil if it has
+// none. Files from before Go 1.17 may only have // +build lines, which the
+// go command still honors; they are combined the way it combines them, so
+// that the generated files, which only use //go:build, match.
+func fileConstraint(f *ast.File) (constraint.Expr, error) {
+	var plus constraint.Expr
+	for _, group := range f.Comments {
+		if group.Pos() > f.Package {
+			break
+		}
+		for _, c := range group.List {
+			if constraint.IsGoBuild(c.Text) {
+				return constraint.Parse(c.Text)
+			}
+			// A // +build line only counts outside of the package
+			// comment, which it must be separated from by a blank line.
+			if group == f.Doc || !constraint.IsPlusBuild(c.Text) {
+				continue
+			}
+			x, err := constraint.Parse(c.Text)
+			if err != nil {
+				return nil, err
+			}
+			plus = andConstraint(plus, x)
+		}
+	}
+	return plus, nil
+}
+
+// mentions reports whether f contains an identifier named name.
+func mentions(f *ast.File, name string) (found bool) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// A scannedPackage is a package matched by the patterns given to
+// [Generator.GenerateAll].
+type scannedPackage struct {
+	*packages.Package
+	dir   string // Relative to the directory the patterns were resolved in.
+	uses  bool   // Whether the package uses the detector type.
+	files []file // The detector files for the package.
+
+	// With Subpackage, the package that imports it, if it has Go files.
+	caller *packages.Package
+
+	// Problems that prevent generation, such as tamper violations.
+	issues []error
+
+	// The error wrapping ErrSyntax for a package that does not parse, in
+	// which case only Package, dir, and invalid are set.
+	invalid error
+}
+
+// scan loads the packages matching patterns and reports which of them use
+// the detector type. The type does not exist until it is generated, so the
+// packages are type-checked with the generated files overlaid on top of
+// whatever is on disk. Packages found in [Generator.CacheDir] are not
+// type-checked at all. It fails if any package has issues or does not
+// parse, except that with [Generator.SkipInvalid], packages that do not
+// parse are left out instead.
+func (g *Generator) scan(
+	dir string, patterns ...string,
+) ([]scannedPackage, error) {
+	scanned, _, err := g.scanValid(dir, patterns...)
+	return scanned, err
+}
+
+// scanValid implements [Generator.scan] and also returns the errors of the
+// packages it left out.
+func (g *Generator) scanValid(
+	dir string, patterns ...string,
+) (scanned []scannedPackage, skipped []error, err error) {
+	pkgs, err := g.scanPackages(dir, patterns...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var errs []error
+	for _, p := range pkgs {
+		switch {
+		case p.invalid != nil && g.SkipInvalid:
+			g.logf("skip %s: %s", p.dir, p.invalid)
+			skipped = append(skipped, p.invalid)
+		case p.invalid != nil:
+			errs = append(errs, p.invalid)
+		default:
+			errs = append(errs, p.issues...)
+			scanned = append(scanned, p)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return scanned, skipped, nil
+}
+
+// scanOne scans the package in dir, which [Generator.SkipInvalid] does not
+// leave out.
+func (g *Generator) scanOne(dir string) (scannedPackage, error) {
+	sg := *g
+	sg.SkipInvalid = false
+	pkgs, err := sg.scan(dir, ".")
+	if err != nil {
+		return scannedPackage{}, err
+	}
+	return pkgs[0], nil
+}
+
+// scanPackages implements [Generator.scan], but leaves the issues it finds
+// with the packages that have them.
+func (g *Generator) scanPackages(
+	dir string, patterns ...string,
+) ([]scannedPackage, error) {
+	if err := checkModule(dir); err != nil {
+		return nil, err
+	}
+	g.logf("list %q in %s using %s", patterns, dir, goCommand())
+	pkgs, err := loadPackages(dir, nil, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		scanned  []scannedPackage
+		reported []ReportPackage
+		batch    = scanBatch{
+			misses:  make(map[string]scannedPackage),
+			keys:    make(map[string]string),
+			overlay: make(map[string][]byte),
+		}
+	)
+	for _, pkg := range pkgs {
+		rel, err := filepath.Rel(abs, pkg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		p := scannedPackage{Package: pkg, dir: filepath.Join(dir, rel)}
+		rp, done, err := g.prescan(&p, &batch)
+		if err != nil {
+			return nil, err
+		} else if done {
+			scanned = append(scanned, p)
+			reported = append(reported, rp)
+		}
+	}
+	pkgs = nil
+	if len(batch.dirs) > 0 {
+		g.logf("type-check %d packages", len(batch.dirs))
+		pkgs, err = loadPackages(dir, batch.overlay, batch.dirs...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, pkg := range pkgs {
+		p, ok := batch.misses[pkg.PkgPath]
+		if !ok {
+			continue
+		}
+		p.Package = pkg
+		rp, err := g.postscan(&p, batch.keys[pkg.PkgPath], batch.overlay)
+		if err != nil {
+			return nil, err
+		}
+		scanned = append(scanned, p)
+		reported = append(reported, rp)
+	}
+	slices.SortFunc(reported, func(a, b ReportPackage) int {
+		return cmp.Compare(a.ImportPath, b.ImportPath)
+	})
+	for _, rp := range reported {
+		g.reportPackage(rp)
+	}
+	slices.SortFunc(scanned, func(a, b scannedPackage) int {
+		return cmp.Compare(a.PkgPath, b.PkgPath)
+	})
+	return scanned, nil
+}
+
+// A scanBatch collects the packages that scanPackages must type-check,
+// which it loads again all at once with their generated files overlaid.
+type scanBatch struct {
+	misses  map[string]scannedPackage // By import path.
+	keys    map[string]string         // Cache keys, by import path.
+	dirs    []string
+	overlay map[string][]byte
+}
+
+// prescan takes what it can about p from the cache, or else generates its
+// files. It reports done if that is all there is to know about p, and
+// otherwise adds it to batch.
+func (g *Generator) prescan(
+	p *scannedPackage, batch *scanBatch,
+) (rp ReportPackage, done bool, err error) {
+	pkg := p.Package
+	rp = ReportPackage{Dir: p.dir, ImportPath: pkg.PkgPath}
+	key, entry, err := g.cached(pkg)
+	if err != nil {
+		return rp, false, err
+	}
+	if entry != nil {
+		g.logf("package %s in %s: cached, uses %s: %t, variables: %q",
+			pkg.PkgPath, p.dir, cmp.Or(g.Type, DefaultType), entry.Uses,
+			entry.Vars)
+		p.uses, p.files = entry.Uses, entry.files()
+		rp.Uses, rp.Vars = entry.Uses, entry.Vars
+		return rp, true, nil
+	}
+	if p.files, err = g.render(pkg); errors.Is(err, ErrSyntax) {
+		p.invalid = err
+		rp.Issues = []string{err.Error()}
+		return rp, true, nil
+	} else if err != nil {
+		return rp, false, err
+	}
+	for _, f := range p.files {
+		path := filepath.Join(pkg.Dir, f.name)
+		g.logf("read %s", path)
+		if _, err := g.readGenerated(path); err != nil {
+			return rp, false, err
+		}
+		batch.overlay[path] = f.data
+	}
+	batch.misses[pkg.PkgPath], batch.keys[pkg.PkgPath] = *p, key
+	batch.dirs = append(batch.dirs, pkg.Dir)
+	return rp, false, nil
+}
+
+// postscan finds the uses of the detector in p, type-checked with the
+// generated files in overlay, and caches the result under key if it has
+// no issues.
+func (g *Generator) postscan(
+	p *scannedPackage, key string, overlay map[string][]byte,
+) (ReportPackage, error) {
+	pkg := p.Package
+	typ := cmp.Or(g.Type, DefaultType)
+	p.uses = usesType(pkg, typ, overlay)
+	issues := slices.Concat(
+		typeArgs(pkg, typ, g.TypeParams, overlay),
+		nilPointers(pkg, typ, g.implMethod()),
+		overrides(pkg, typ, append(g.methods(), g.implMethod()), overlay),
+	)
+	if g.Extend && p.uses {
+		issues = append(issues, extension(pkg, typ,
+			cmp.Or(g.Method, DefaultMethod), g.implMethod(), overlay)...)
+	}
+	p.issues = issues
+	vars := slices.Concat(
+		detectorVars(pkg, typ),
+		interfaceVars(pkg, typ),
+	)
+	slices.Sort(vars)
+	g.logf("package %s in %s: uses %s: %t, variables: %q",
+		pkg.PkgPath, p.dir, typ, p.uses, vars)
+	rp := ReportPackage{
+		Dir:        p.dir,
+		ImportPath: pkg.PkgPath,
+		Uses:       p.uses,
+		Vars:       vars,
+	}
+	for _, err := range issues {
+		rp.Issues = append(rp.Issues, err.Error())
+	}
+	if len(issues) == 0 {
+		err := g.cache(key, p.uses, vars, p.files)
+		if err != nil {
+			return rp, err
+		}
+	}
+	return rp, nil
+}
+
+// goCommand returns the path of the go command that loads packages, which
+// also determines the compiler and toolchain they are checked against.
+func goCommand() string {
+	path, err := exec.LookPath("go")
+	if err != nil {
+		return "go"
+	}
+	return path
+}
+
+// toolchainVersion returns the version of the go command, which generated
+// code targets by default. Development versions, which go/version cannot
+// compare, are reported as the release they precede.
+var toolchainVersion = sync.OnceValues(func() (string, error) {
+	out, err := exec.Command(goCommand(), "env", "GOVERSION").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not run go env GOVERSION: %w", err)
+	}
+	v := strings.TrimSpace(string(out))
+	if dev, ok := strings.CutPrefix(v, "devel "); ok {
+		v, _, _ = strings.Cut(dev, "-")
+	}
+	return v, nil
+})
+
+// checkModule returns an error wrapping [ErrNoModule] if dir is not inside
+// a module, where the go command would otherwise fail to load packages with
+// a less helpful message. GOPATH mode, with GO111MODULE=off, is left alone.
+func checkModule(dir string) error {
+	cmd := exec.Command(goCommand(), "env", "GOMOD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("could not run go env in %s: %w", dir, err)
+	}
+	if strings.TrimSpace(string(out)) == os.DevNull {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		return withKind(ErrNoModule, fmt.Errorf("no go.mod found in %s "+
+			"or any parent directory: run go mod init to create one", dir))
+	}
+	return nil
+}
+
+// loadPackages loads the packages matching patterns. With a nil overlay it
+// only lists them; otherwise it also parses and type-checks them with the
+// overlay applied. Packages that list cleanly but fail to compile, perhaps
+// for want of another generated type, may still need a detector, so errors
+// are only reported when listing.
+func loadPackages(
+	dir string, overlay map[string][]byte, patterns ...string,
+) ([]*packages.Package, error) {
+	mode := packages.NeedName | packages.NeedFiles
+	if overlay != nil {
+		mode |= packages.NeedSyntax | packages.NeedTypes |
+			packages.NeedTypesInfo
+	}
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:    mode,
+		Dir:     dir,
+		Overlay: overlay,
+	}, patterns...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load packages %q: %w", patterns, err)
+	}
+	if overlay != nil {
+		return pkgs, nil
+	}
+	var pkgErrs []error
+	for _, pkg := range pkgs {
+		if !parses(pkg) {
+			continue // Reported with ErrSyntax once the package is scanned.
+		}
+		for _, err := range pkg.Errors {
+			pkgErrs = append(pkgErrs, err)
+		}
+	}
+	if len(pkgErrs) > 0 {
+		return nil, errors.Join(
+			append(
+				[]error{fmt.Errorf("could not load packages %q", patterns)},
+				pkgErrs...,
+			)...,
+		)
+	}
+	return pkgs, nil
+}
+
+// hasTestMain reports whether the test files in dir, other than the one
+// named own, declare a TestMain function. One that does not take a
+// *testing.M, and is therefore an ordinary test, is an error: it leaves no
+// room for a generated TestMain. So is one generated for another detector
+// type: it does not run this one's cleanups, and there cannot be two.
+func hasTestMain(dir, own string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not read %s: %w", dir, err)
+	}
+	fset := token.NewFileSet()
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, "_test.go") || name == own {
+			continue
+		}
+		found, err := fileTestMain(fset, filepath.Join(dir, name))
+		if found || err != nil {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// fileTestMain is [hasTestMain] for the test file at path.
+func fileTestMain(fset *token.FileSet, path string) (bool, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	f, err := parser.ParseFile(fset, path, src, parser.SkipObjectResolution)
+	if err != nil {
+		return false, withKind(ErrSyntax,
+			fmt.Errorf("could not parse %s: %w", path, err))
+	}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Name.Name != "TestMain" {
+			continue
+		}
+		if !takesTestingM(fn) {
+			return false, fmt.Errorf("%s: TestMain does not take a "+
+				"*testing.M, so cleanups cannot run after it",
+				fset.Position(fn.Name.Pos()))
+		} else if bytes.HasPrefix(src, []byte(header)) {
+			return false, fmt.Errorf("%s: TestMain is generated for "+
+				"another detector type, so it does not run this one's "+
+				"cleanups; declare your own that runs both",
+				fset.Position(fn.Name.Pos()))
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// takesTestingM reports whether fn takes a single *testing.M, or at least
+// a pointer to some type named M, since the file is not type-checked.
+func takesTestingM(fn *ast.FuncDecl) bool {
+	params := fn.Type.Params.List
+	if len(params) != 1 {
+		return false
+	}
+	ptr, _ := params[0].Type.(*ast.StarExpr)
+	if ptr == nil {
+		return false
+	}
+	sel, _ := ptr.X.(*ast.SelectorExpr)
+	return sel != nil && sel.Sel.Name == "M"
+}
+
+// parses reports whether the package clauses and imports of the files of
+// pkg parse, which is as far as go list reads them.
+func parses(pkg *packages.Package) bool {
+	fset := token.NewFileSet()
+	for _, name := range slices.Concat(pkg.GoFiles, pkg.IgnoredFiles) {
+		_, err := parser.ParseFile(fset, name, nil, parser.ImportsOnly)
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
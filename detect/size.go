@@ -0,0 +1,109 @@
+package detect
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A Size compares the size of a program binary built with the generated
+// detector to a baseline built with a bare type whose methods return
+// constants, which is as small as a detector can be.
+type Size struct {
+	Detector int64 // Size in bytes with the generated detector.
+	Baseline int64 // Size in bytes with the bare type.
+}
+
+// Delta returns the number of bytes attributable to the generated detector.
+func (s Size) Delta() int64 { return s.Detector - s.Baseline }
+
+// Percent returns [Size.Delta] as a percentage of the baseline.
+func (s Size) Percent() float64 {
+	if s.Baseline == 0 {
+		return 0
+	}
+	return 100 * float64(s.Delta()) / float64(s.Baseline)
+}
+
+// Size builds the main package in dir twice, once with the detector
+// source files [Generator.Generate] would write and once with a bare
+// stand-in, and reports the size of each program binary. Neither build
+// modifies the package. The package must use the detector type, or the
+// comparison would be meaningless.
+func (g *Generator) Size(dir string) (size Size, err error) {
+	if err := g.validate(); err != nil {
+		return size, err
+	}
+	scanned, err := g.scanOne(dir)
+	if err != nil {
+		return size, err
+	}
+	pkg, files := scanned.Package, scanned.files
+	if pkg.Name != "main" {
+		return size, fmt.Errorf("%s is not a main package", dir)
+	}
+	typ := cmp.Or(g.Type, DefaultType)
+	if !scanned.uses {
+		return size, withKind(ErrNoDetector,
+			fmt.Errorf("%s does not use %s", dir, typ))
+	}
+	expr, err := buildConstraint(pkg, typ, g.base())
+	if err != nil {
+		return size, err
+	}
+	stub, err := g.renderStub(pkg, g.variantConstraint(expr, false))
+	if err != nil {
+		return size, err
+	}
+
+	tmp, err := os.MkdirTemp("", "testdetect")
+	if err != nil {
+		return size, err
+	}
+	defer os.RemoveAll(tmp)
+	// Only the first file is part of the program binary.
+	path := filepath.Join(pkg.Dir, files[0].name)
+	size.Detector, err = g.buildSize(dir, tmp, path, files[0].data)
+	if err != nil {
+		return size, err
+	}
+	if size.Baseline, err = g.buildSize(dir, tmp, path, stub); err != nil {
+		return size, err
+	}
+	return size, nil
+}
+
+// buildSize builds the main package in dir with the file at path replaced
+// by data and returns the size of the program binary. It keeps its
+// scratch files in tmp.
+func (g *Generator) buildSize(
+	dir, tmp, path string, data []byte,
+) (int64, error) {
+	src := filepath.Join(tmp, "detector.go")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		return 0, err
+	}
+	overlay, err := json.Marshal(map[string]map[string]string{
+		"Replace": {path: src},
+	})
+	if err != nil {
+		return 0, err
+	}
+	overlayPath := filepath.Join(tmp, "overlay.json")
+	if err := os.WriteFile(overlayPath, overlay, 0644); err != nil {
+		return 0, err
+	}
+	bin := filepath.Join(tmp, exe("out"))
+	g.logf("build %s with %s", dir, src)
+	err = goBuild(dir, "build", "-overlay", overlayPath, "-o", bin, ".")
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(bin)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
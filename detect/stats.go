@@ -0,0 +1,98 @@
+package detect
+
+import (
+	"cmp"
+	"errors"
+	"go/ast"
+	"go/types"
+	"path/filepath"
+)
+
+// Stats summarizes how a set of packages uses the detector.
+// Its JSON encoding is stable.
+type Stats struct {
+	Packages int // Number of packages scanned.
+	Uses     int // Number of packages that use the detector type.
+
+	// Calls is the number of calls to the detector method on a value of
+	// the detector type, outside of test files and generated files.
+	Calls int
+
+	// Tampered lists the import paths of the packages with methods that
+	// override a generated detector method, in import path order.
+	Tampered []string
+}
+
+// Stats reports how the packages matching patterns use the detector. Unlike
+// generation, it does not fail on packages with tamper violations, but lists
+// them. It does not modify anything.
+func (g *Generator) Stats(dir string, patterns ...string) (*Stats, error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	pkgs, err := g.uncached().scanPackages(dir, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	typ := cmp.Or(g.Type, DefaultType)
+	method := cmp.Or(g.Method, DefaultMethod)
+	stats := new(Stats)
+	for _, pkg := range pkgs {
+		if pkg.invalid != nil {
+			if g.SkipInvalid {
+				continue
+			}
+			return nil, pkg.invalid
+		}
+		stats.Packages++
+		for _, err := range pkg.issues {
+			if errors.Is(err, ErrTamper) {
+				stats.Tampered = append(stats.Tampered, pkg.PkgPath)
+				break
+			}
+		}
+		if !pkg.uses {
+			continue
+		}
+		stats.Uses++
+		stats.Calls += calls(pkg, typ, method)
+	}
+	return stats, nil
+}
+
+// calls counts the calls to method on values of the detector type named
+// typ in the files of pkg, other than the generated ones.
+func calls(pkg scannedPackage, typ, method string) (count int) {
+	obj := detectorType(pkg.Package, typ)
+	if obj == nil {
+		return 0
+	}
+	own := make(map[string]bool)
+	for _, f := range pkg.files {
+		own[f.name] = true
+	}
+	for _, f := range pkg.Syntax {
+		if own[filepath.Base(pkg.Fset.File(f.Pos()).Name())] {
+			continue
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != method {
+				return true
+			}
+			s, ok := pkg.TypesInfo.Selections[sel]
+			if !ok || s.Kind() != types.MethodVal {
+				return true
+			}
+			if isDetector(s.Recv(), obj) {
+				count++
+			}
+			return true
+		})
+	}
+	return count
+}
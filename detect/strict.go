@@ -0,0 +1,155 @@
+package detect
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Strict reports an error if the generated files in dir do not declare
+// exactly the detector methods that g is configured to generate. See
+// [Generator.StrictAll].
+func (g *Generator) Strict(dir string) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	pkg, err := g.target(dir)
+	if err != nil {
+		return err
+	}
+	return g.strict(pkg)
+}
+
+// StrictAll reports an error for every package matching patterns that
+// [Generator.GenerateAll] would generate into whose generated files declare
+// methods on the detector type that g is not configured to generate, lack
+// some that it is, or are left over from other options, such as a
+// _testdetect.go file outside of [ModeBuildTag]. These are signs that the
+// options changed without the files being regenerated. Unlike
+// [Generator.CheckAll], it ignores every other difference, such as a newer
+// generator version. It does not modify anything.
+func (g *Generator) StrictAll(dir string, patterns ...string) error {
+	if err := g.validate(); err != nil {
+		return err
+	} else if g.Subpackage != "" {
+		return errors.New("StrictAll does not support Subpackage")
+	}
+	pkgs, err := g.scan(dir, patterns...)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, pkg := range pkgs {
+		if !pkg.uses {
+			continue
+		}
+		if err := g.strict(pkg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (g *Generator) strict(pkg scannedPackage) error {
+	typ := cmp.Or(g.Type, DefaultType)
+	recvs := []string{
+		typ, unexported(typ) + "Override", unexported(typ) + "Embed",
+	}
+	var errs []error
+	want := make(map[string]bool)
+	for _, f := range pkg.files {
+		want[f.name] = true
+		path := filepath.Join(pkg.dir, f.name)
+		g.logf("read %s", path)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("%s is missing; regenerate it",
+				path))
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not read %s: %w", path, err)
+		}
+		have, err := declaredMethods(path, data, recvs)
+		if err != nil {
+			return err
+		}
+		configured, err := declaredMethods(path, f.data, recvs)
+		if err != nil {
+			return err
+		}
+		for _, name := range have {
+			if !slices.Contains(configured, name) {
+				errs = append(errs, fmt.Errorf("%s declares %s(), which "+
+					"is not configured; regenerate it", path, name))
+			}
+		}
+		for _, name := range configured {
+			if !slices.Contains(have, name) {
+				errs = append(errs, fmt.Errorf("%s lacks %s(), which is "+
+					"configured; regenerate it", path, name))
+			}
+		}
+	}
+	base := g.base()
+	for _, name := range []string{
+		base + ".go",
+		base + "_test.go",
+		base + "_testdetect.go",
+		base + "_off.go",
+		base + "_ignore.go",
+	} {
+		if want[name] {
+			continue
+		}
+		path := filepath.Join(pkg.dir, name)
+		data, err := os.ReadFile(path)
+		if err == nil && bytes.HasPrefix(data, []byte(header)) {
+			errs = append(errs, fmt.Errorf("%s is left over from other "+
+				"options; remove it", path))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// declaredMethods returns the names of the methods in the Go source data
+// whose receiver type is named one of recvs, in source order.
+func declaredMethods(path string, data []byte, recvs []string) (
+	names []string, err error,
+) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, data,
+		parser.SkipObjectResolution)
+	if err != nil {
+		return nil, withKind(ErrSyntax,
+			fmt.Errorf("could not parse %s: %w", path, err))
+	}
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) == 0 {
+			continue
+		}
+		t := fn.Recv.List[0].Type
+		if star, ok := t.(*ast.StarExpr); ok {
+			t = star.X
+		}
+		switch x := t.(type) {
+		case *ast.IndexExpr:
+			t = x.X
+		case *ast.IndexListExpr:
+			t = x.X
+		}
+		id, ok := t.(*ast.Ident)
+		if ok && slices.Contains(recvs, id.Name) &&
+			!slices.Contains(names, fn.Name.Name) {
+			names = append(names, fn.Name.Name)
+		}
+	}
+	return names, nil
+}
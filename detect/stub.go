@@ -0,0 +1,154 @@
+package detect
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"go/build/constraint"
+	"go/format"
+	"text/template"
+
+	"golang.org/x/tools/go/packages"
+)
+
+//nolint:lll
+var testingDetectorStub = template.Must(template.New("").Parse(`// Code generated by lesiw.io/testdetect {{.Version}}. DO NOT EDIT.
+{{- with .Constraint}}
+
+//go:build {{.}}
+
+{{- end}}
+package {{.Package}}
+{{- if .OnTestingContext}}
+
+import "context"
+{{- end}}
+
+type {{.TypeDecl}} struct{}
+{{- if .BackingFunc}}
+
+var {{.Type}}Backing func() bool
+{{- end}}
+{{range .Methods}}
+func ({{$.Recv}}) {{.}}() bool { return false }
+{{- end}}
+{{- with .Export}}
+
+func {{.}}() bool { return false }
+{{- end}}
+{{- with .Hook}}
+
+var {{.}} bool
+{{- end}}
+{{- if .RunFilter}}
+func ({{.Recv}}) RunFilter() string { return "" }
+{{- end}}
+{{- if .Sanitizer}}
+func ({{.Recv}}) Sanitizer() string { return "" }
+{{- end}}
+{{- if .TestName}}
+func ({{.Recv}}) TestName() string { return "" }
+{{- end}}
+{{- if .TestPath}}
+func ({{.Recv}}) TestPath() []string { return nil }
+{{- end}}
+{{- if .Iteration}}
+func ({{.Recv}}) Iteration() int { return 0 }
+{{- end}}
+{{- if .OnTesting}}
+func ({{.Recv}}) OnTesting(func({{if .OnTestingContext}}context.Context{{end}})) {}
+{{- end}}
+{{- if .CleanupOnTesting}}
+func ({{.Recv}}) CleanupOnTesting(func()) {}
+{{- end}}
+{{- if .ModeMethod}}
+func ({{.Recv}}) Mode() {{.Type}}Mode { return {{.Type}}Mode{} }
+
+type {{.Type}}Mode struct {
+	Testing, Benchmarking, Fuzzing, Coverage, Short bool
+}
+{{- end}}
+`))
+
+type stubData struct {
+	Version     string
+	Package     string
+	Type        string
+	TypeDecl    string
+	Recv        string
+	Constraint  string
+	Methods     []string // Methods returning bool.
+	Export      string
+	Hook        string
+	BackingFunc bool
+	RunFilter   bool
+	Sanitizer   bool
+	TestName    bool
+	TestPath    bool
+	Iteration   bool
+	OnTesting   bool
+	ModeMethod  bool
+
+	CleanupOnTesting bool
+	OnTestingContext bool
+}
+
+// renderStub returns a bare stand-in for the detector type in pkg, whose
+// methods all return zero values, under the build constraint expr.
+func (g *Generator) renderStub(
+	pkg *packages.Package, expr constraint.Expr,
+) ([]byte, error) {
+	typ := cmp.Or(g.Type, DefaultType)
+	decl, recv, _ := g.typeExprs()
+	data := stubData{
+		Version:     Version(),
+		Package:     pkg.Name,
+		Type:        typ,
+		TypeDecl:    decl,
+		Recv:        recv,
+		Methods:     []string{g.implMethod()},
+		BackingFunc: g.Backing == BackingFunc,
+		RunFilter:   g.RunFilter,
+		Sanitizer:   g.Sanitizer,
+		TestName:    g.TestName,
+		TestPath:    g.TestPath,
+		Iteration:   g.Iteration,
+		OnTesting:   g.OnTesting,
+		ModeMethod:  g.ModeMethod,
+
+		CleanupOnTesting: g.CleanupOnTesting,
+		OnTestingContext: g.OnTestingContext,
+	}
+	for _, name := range g.methods() {
+		switch name {
+		case "RunFilter", "Sanitizer", "TestName", "TestPath",
+			"Iteration", "OnTesting", "CleanupOnTesting", "Mode":
+		default:
+			data.Methods = append(data.Methods, name)
+		}
+	}
+	if g.Subpackage != "" {
+		data.Export = cmp.Or(g.Method, DefaultMethod)
+		if g.Mode != ModeBuildTag {
+			data.Hook = exported(typ) + "Hook"
+		}
+	}
+	pointer, err := declaresPointer(pkg, typ, g.base())
+	if err != nil {
+		return nil, err
+	} else if pointer {
+		data.Recv = "*" + recv
+	}
+	if expr != nil {
+		data.Constraint = expr.String()
+	}
+	var buf bytes.Buffer
+	if err := testingDetectorStub.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("could not generate stub: %w", err)
+	}
+	stub, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("could not format stub: %w", err)
+	}
+	return stub, nil
+}
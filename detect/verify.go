@@ -0,0 +1,239 @@
+package detect
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// compileErr matches the position that starts a compiler error.
+var compileErr = regexp.MustCompile(`(?m)^(\S+\.go):\d+(:\d+)?: `)
+
+// verify builds the package in dir and its test binary with the compiler
+// of g, returning an error that names the first file the compiler
+// complained about along with its output. TinyGo only builds programs, so
+// under TinyGo verify only builds the test binary of other packages.
+func (g *Generator) verify(dir string, main bool) error {
+	tc := g.toolchain()
+	g.logf("verify %s using %s", dir, tc.path)
+	// TinyGo picks the output format from the file name, so it cannot
+	// write to os.DevNull.
+	tmp, err := os.MkdirTemp("", "testdetect")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, args := range [][]string{
+		{"build", "-o", filepath.Join(tmp, exe("out")), "."},
+		{"test", "-c", "-o", filepath.Join(tmp, exe("out.test")), "."},
+	} {
+		if args[0] == "build" && tc.name == "tinygo" && !main {
+			continue
+		}
+		err := tc.build(dir, args...)
+		var buildErr *buildError
+		if err == nil {
+			continue
+		} else if !errors.As(err, &buildErr) {
+			return err
+		}
+		file := dir
+		if m := compileErr.FindStringSubmatch(buildErr.stderr); m != nil {
+			file = m[1]
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+		}
+		return withKind(ErrBuild, fmt.Errorf(
+			"%s: %s %s failed after generation: %w\n%s",
+			file, tc.name, args[0], buildErr.err, buildErr.stderr))
+	}
+	return nil
+}
+
+// A buildError is a build command that ran and failed.
+type buildError struct {
+	name   string // Name of the compiler, as in go or tinygo.
+	args   []string
+	err    error
+	stderr string
+}
+
+func (e *buildError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s\n%s",
+		e.name, strings.Join(e.args, " "), e.err, e.stderr)
+}
+
+func (e *buildError) Unwrap() []error {
+	return []error{ErrBuild, e.err}
+}
+
+// exe returns name with the executable suffix of the target GOOS, which
+// the go command adds when choosing an output name itself.
+func exe(name string) string {
+	if cmp.Or(os.Getenv("GOOS"), runtime.GOOS) == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// A toolchain is a compiler to build packages with, along with what it
+// takes to run it.
+type toolchain struct {
+	name  string   // Name of the compiler, as in go or tinygo.
+	path  string   // Command to run.
+	flags []string // Flags following the subcommand, as in build.
+	env   []string // Environment, or nil to inherit it.
+}
+
+// toolchain returns the compiler named by g.Compiler, the GOCOMPILER
+// environment variable, or the go command, whichever is set first. TinyGo
+// accepts the same build and test -c flags as the go command; gccgo is
+// driven through the go command's -compiler flag.
+func (g *Generator) toolchain() toolchain {
+	gc := cmp.Or(g.Compiler, os.Getenv("GOCOMPILER"), goCommand())
+	switch strings.TrimSuffix(filepath.Base(gc), ".exe") {
+	case "tinygo":
+		return toolchain{name: "tinygo", path: gc}
+	case "gccgo":
+		return toolchain{
+			name:  "gccgo",
+			path:  goCommand(),
+			flags: []string{"-compiler=gccgo"},
+			env:   append(os.Environ(), "GCCGO="+gc),
+		}
+	}
+	return toolchain{name: "go", path: gc}
+}
+
+// build runs the subcommand args[0] of tc with the rest of args in dir. If
+// the command runs but fails, the error is a *buildError, which wraps
+// [ErrBuild].
+func (tc toolchain) build(dir string, args ...string) error {
+	args = slices.Concat(args[:1], tc.flags, args[1:])
+	var stderr bytes.Buffer
+	cmd := exec.Command(tc.path, args...)
+	cmd.Dir, cmd.Env = dir, tc.env
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return &buildError{
+			name:   tc.name,
+			args:   args,
+			err:    err,
+			stderr: string(bytes.TrimSpace(stderr.Bytes())),
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not run %s %s: %w", tc.name, args[0], err)
+	}
+	return nil
+}
+
+// BuildBinaries builds the main package in dir and its test binary and
+// returns their contents, so that a project's own tests can check that
+// test-only code, such as a string only a test branch prints, stays out of
+// the program binary. The GOCOMPILER environment variable names the
+// compiler to use: the go command by default, or a tinygo or gccgo binary.
+// The binaries are built in a temporary directory, which is removed before
+// BuildBinaries returns. If either build fails, the error wraps [ErrBuild].
+func BuildBinaries(dir string) (bin, testbin []byte, err error) {
+	return new(Generator).BuildBinaries(dir)
+}
+
+// BuildBinaries is like the package-level BuildBinaries, but builds with
+// g.Compiler when it is set.
+func (g *Generator) BuildBinaries(
+	dir string,
+) (bin, testbin []byte, err error) {
+	tc := g.toolchain()
+	tmp, err := os.MkdirTemp("", "testdetect")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+	build := func(out string, args ...string) ([]byte, error) {
+		path := filepath.Join(tmp, exe(out))
+		err := tc.build(dir, slices.Concat(args, []string{"-o", path, "."})...)
+		var buildErr *buildError
+		if errors.As(err, &buildErr) {
+			return nil, withKind(ErrBuild, fmt.Errorf("%s %s failed: %w\n%s",
+				tc.name, strings.Join(args, " "), buildErr.err,
+				buildErr.stderr))
+		} else if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(path)
+	}
+	var eg errgroup.Group
+	eg.Go(func() (err error) {
+		bin, err = build("out", "build")
+		return err
+	})
+	eg.Go(func() (err error) {
+		testbin, err = build("out.test", "test", "-c")
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return bin, testbin, nil
+}
+
+// goBuild runs the go command with args in dir. If the command runs but
+// fails, the error is a *buildError, which wraps [ErrBuild]. The command
+// inherits the environment, so GOFLAGS, GOPROXY, and the rest apply to it
+// as they would to the go command run by hand, and a vendor directory
+// selects -mod=vendor unless GOFLAGS says otherwise.
+func goBuild(dir string, args ...string) error {
+	return toolchain{name: "go", path: goCommand()}.build(dir, args...)
+}
+
+// assertNoTesting builds the main package in dir with the compiler of g and
+// returns an error if the program binary contains symbols from the testing
+// package. That compiler is a go command, which validate checks.
+func (g *Generator) assertNoTesting(dir string) error {
+	tc := g.toolchain()
+	g.logf("check %s for testing symbols using %s", dir, tc.path)
+	tmp, err := os.MkdirTemp("", "testdetect")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	bin := filepath.Join(tmp, exe("out"))
+	if err := tc.build(dir, "build", "-o", bin, "."); err != nil {
+		return err
+	}
+	out, err := exec.Command(tc.path, "tool", "nm", bin).Output()
+	if err != nil {
+		return fmt.Errorf("could not list symbols of %s: %w", dir, err)
+	}
+	var syms []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// Each line is an address (absent for undefined symbols), a
+		// symbol type, and a name.
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if name := fields[len(fields)-1]; strings.HasPrefix(name, "testing.") {
+			syms = append(syms, name)
+		}
+	}
+	if len(syms) > 0 {
+		return withKind(ErrBuild, fmt.Errorf(
+			"%s: program binary links the testing package: %s",
+			dir, strings.Join(syms, ", ")))
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package detect
+
+import "runtime/debug"
+
+// modulePath is the path of the module that provides this package.
+const modulePath = "lesiw.io/testdetect"
+
+// Version returns the version of lesiw.io/testdetect linked into the running
+// binary, as recorded in its build information, or "devel" if it was built
+// from a local checkout.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	mod := &info.Main
+	if mod.Path != modulePath {
+		mod = nil
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				mod = dep
+				break
+			}
+		}
+	}
+	if mod == nil {
+		return "devel"
+	}
+	if mod.Replace != nil {
+		mod = mod.Replace
+	}
+	if mod.Version == "" || mod.Version == "(devel)" {
+		return "devel"
+	}
+	return mod.Version
+}
@@ -0,0 +1,72 @@
+package detect
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+// Workspace returns the module directories listed by the use directives of
+// the go.work file governing dir. Like the go command, it honors the GOWORK
+// environment variable and otherwise looks for go.work in dir and its
+// parents. The returned directories are relative to dir when the go.work
+// file uses relative paths.
+func Workspace(dir string) ([]string, error) {
+	path, err := findWork(dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	work, err := modfile.ParseWork(path, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var mods []string
+	for _, use := range work.Use {
+		mod := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(mod) {
+			mod = filepath.Join(filepath.Dir(path), mod)
+			if rel, err := filepath.Rel(abs, mod); err == nil {
+				mod = filepath.Join(dir, rel)
+			}
+		}
+		mods = append(mods, mod)
+	}
+	return mods, nil
+}
+
+func findWork(dir string) (string, error) {
+	switch gowork := os.Getenv("GOWORK"); gowork {
+	case "off":
+		return "", errors.New("workspace mode disabled by GOWORK=off")
+	case "":
+	default:
+		return gowork, nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		path := filepath.Join(d, "go.work")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("could not stat %s: %w", path, err)
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("could not find go.work in %q", dir)
+		}
+	}
+}
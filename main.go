@@ -2,114 +2,793 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 
-	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/txtar"
+	"lesiw.io/testdetect/detect"
 )
 
-//nolint:lll
-const testingDetector = `// Code generated by lesiw.io/testdetect. DO NOT EDIT.
-package %s
+func main() {
+	err := run(os.Args[1:]...)
+	if errors.Is(err, flag.ErrHelp) {
+		return // The flag set already printed the usage message.
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
+	}
+}
 
-type testingDetector struct{ testingDetectorEmbed }
-type testingDetectorEmbed struct{}
+// Exit codes, by the class of failure.
+const (
+	exitFailure    = 1 // Any failure not described below.
+	exitUsage      = 2 // Bad flags, arguments, or option values.
+	exitNoDetector = 3 // No package uses the detector.
+	exitTamper     = 4 // Hand-written code subverts the detector.
+	exitConflict   = 5 // A generated name is taken by a hand-written file.
+	exitBuild      = 6 // Building a package or checking its binary failed.
+	exitIO         = 7 // Reading or writing a file failed.
+)
 
-func (t testingDetectorEmbed) Testing() bool { return false }
+// exitCode returns the exit code for err. An error that combines failures
+// of several classes gets the lowest of their codes other than exitFailure.
+func exitCode(err error) int {
+	var (
+		usage   usageError
+		pathErr *fs.PathError
+	)
+	switch {
+	case errors.As(err, &usage), errors.Is(err, detect.ErrOption):
+		return exitUsage
+	case errors.Is(err, detect.ErrNoDetector):
+		return exitNoDetector
+	case errors.Is(err, detect.ErrTamper):
+		return exitTamper
+	case errors.Is(err, detect.ErrConflict):
+		return exitConflict
+	case errors.Is(err, detect.ErrBuild):
+		return exitBuild
+	case errors.As(err, &pathErr):
+		return exitIO
+	}
+	return exitFailure
+}
 
-var _ = (testingDetector{}).testingDetectorEmbed
-`
+// A usageError is a mistake in the command line.
+type usageError struct{ err error }
 
-//nolint:lll
-const testingDetectorTamperProtection = `
+func (e usageError) Error() string { return e.err.Error() }
 
-import (
-	"fmt"
-	"testing"
-)
+func (e usageError) Unwrap() error { return e.err }
 
-var testingDetectorCovHack bool
+func usagef(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
 
-func init() { testingDetectorInit() }
-func testingDetectorInit() {
-	if got, want := (testingDetector{}).Testing(), testing.Testing(); testingDetectorCovHack || got != want {
-		panic(fmt.Sprintf("bad testingDetector state: got %t, want %t", got, want))
-	}
-}`
+// A noDetectorError reports that none of the packages generation was asked
+// to visit uses the detector type.
+type noDetectorError struct {
+	typ     string
+	skipped int
+}
+
+func (e noDetectorError) Error() string {
+	return fmt.Sprintf("no package uses %s, skipped %d", e.typ, e.skipped)
+}
 
-//nolint:lll
-const testingDetectorTest = `// Code generated by lesiw.io/testdetect. DO NOT EDIT.
-package %s
+func (e noDetectorError) Is(target error) bool {
+	return target == detect.ErrNoDetector
+}
 
-func (t testingDetector) Testing() bool { return true }
+// A command is a parsed command line: the generator its flags configure,
+// what to do with it, and the jobs to do that for.
+type command struct {
+	g    detect.Generator
+	name string // The subcommand, if any: test, clean, size, or stats.
 
-var _ = (testingDetector{}).testingDetectorEmbed.Testing()
-`
+	check, diff, lint, dryRun, emit bool
+	watching, strict, recursive     bool
+	jsonOut                         bool
 
-var testingDetectorTamperProtectionTest = `func init() {
-	testingDetectorCovHack = true
-	defer func() { recover() }()
-	testingDetectorInit()
+	jobs           []job
+	stdout, stderr io.Writer
 }
-`
 
-func main() {
-	if err := run(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
+// A job visits the packages matching patterns in dir.
+type job struct {
+	g        *detect.Generator
+	dir      string
+	patterns []string
 }
 
-func run() error {
-	pkg, err := pkgname(".")
+// subcommands lists the subcommands that take the generator flags.
+var subcommands = []string{"test", "clean", "size", "stats"}
+
+func run(args ...string) error {
+	args, err := changeDir(args)
 	if err != nil {
 		return err
 	}
-	ins := pkg
-	if pkg == "main" {
-		ins += testingDetectorTamperProtection
+	if len(args) > 0 && args[0] == "version" {
+		return runVersion(args[1:])
 	}
-	err = os.WriteFile(
-		"testing_detector.go",
-		[]byte(fmt.Sprintf(testingDetector, ins)), 0644,
-	)
+	c, err := parse(args)
 	if err != nil {
-		return fmt.Errorf("could not write testing_detector.go: %w", err)
+		return err
+	}
+	defer c.report()
+	switch {
+	case c.name == "size":
+		return c.runSize()
+	case c.name == "stats":
+		return c.runStats()
+	case c.name == "clean":
+		return c.runClean()
+	case c.lint:
+		return c.runLint()
+	case c.strict:
+		return c.runStrict()
+	case c.check:
+		return c.runCheck()
+	case c.watching:
+		return c.runWatch()
+	case c.emit:
+		return c.runStdout()
+	}
+	return c.runGenerate()
+}
+
+// parse parses the command line args, which start with the subcommand if
+// there is one.
+func parse(args []string) (*command, error) {
+	c := &command{stdout: os.Stdout, stderr: os.Stderr}
+	if len(args) > 0 && slices.Contains(subcommands, args[0]) {
+		c.name, args = args[0], args[1:]
+	}
+	var (
+		workspace bool
+		verbose   bool
+		quiet     bool
+		cache     bool
+		mode      string
+		backing   string
+		tamper    string
+	)
+	flags := flag.NewFlagSet("testdetect", flag.ContinueOnError)
+	var chdir string
+	flags.StringVar(&chdir, "C", "", "change to `dir` before doing anything "+
+		"(must be the first flag)")
+	flags.StringVar(&c.g.Type, "type", detect.DefaultType,
+		"`name` of the generated detector type")
+	flags.Func("type-params", "comma-separated `names` of type parameters "+
+		"of a generic detector type", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			c.g.TypeParams = append(c.g.TypeParams, strings.TrimSpace(name))
+		}
+		return nil
+	})
+	flags.StringVar(&c.g.Method, "method", detect.DefaultMethod,
+		"`name` of the generated detector method")
+	flags.BoolVar(&c.g.NoTamper, "no-tamper", false,
+		"omit the tamper check from main packages")
+	flags.BoolVar(&c.g.Extend, "extend", false,
+		"leave the detector method to your own code, which must call the "+
+			"generated <type>Flag method")
+	flags.StringVar(&c.g.TamperMsg, "tamper-msg", detect.DefaultTamperMsg,
+		"`template` for the tamper check panic message, "+
+			"using {{.Type}}, {{.Method}}, {{.Got}}, and {{.Want}}")
+	flags.StringVar(&tamper, "tamper", string(detect.TamperPanic),
+		"`what` a failed tamper check does: panic or log")
+	flags.StringVar(&c.g.Subpackage, "package", "",
+		"`dir` of a package to put the detector in, with an exported "+
+			"function calling its method, instead of the current one")
+	flags.StringVar(&c.g.Out, "out", "",
+		"base `name` of the generated files (default derived from -type)")
+	flags.StringVar(&mode, "mode", string(detect.ModeTest),
+		"`how` the detector tells test binaries apart: test or buildtag")
+	flags.StringVar(&c.g.GoVersion, "go", "",
+		"oldest Go `version` the generated code must build with "+
+			"(default from go env GOVERSION)")
+	flags.StringVar(&backing, "backing", string(detect.BackingMethod),
+		"`what` backs the detector in test binaries: method or func")
+	flags.BoolVar(&c.g.OffTag, "off-tag", false,
+		"make the detector report false in test binaries built with "+
+			"-tags "+detect.OffTag)
+	flags.BoolVar(&c.g.Expvar, "expvar", false,
+		"count calls to the detector method in test binaries in an "+
+			"expvar counter")
+	flags.BoolVar(&c.g.Guard, "guard", false,
+		"exclude the generated files from builds with -tags "+
+			detect.IgnoreTag+", for tools that load files out of context")
+	flags.BoolVar(&c.g.Benchmarking, "bench-detect", false,
+		"generate a Benchmarking method")
+	flags.BoolVar(&c.g.Fuzzing, "fuzz-detect", false,
+		"generate a Fuzzing method")
+	flags.BoolVar(&c.g.Coverage, "cover-detect", false,
+		"generate a Coverage method")
+	flags.BoolVar(&c.g.CoverExclude, "cover-exclude", false,
+		"keep generated code from lowering test coverage")
+	flags.BoolVar(&c.g.Race, "race-detect", false,
+		"generate a Race method")
+	flags.BoolVar(&c.g.Sanitizer, "sanitizer-detect", false,
+		"generate a Sanitizer method reporting race, msan, or asan")
+	flags.BoolVar(&c.g.Short, "short-detect", false,
+		"generate a Short method")
+	flags.BoolVar(&c.g.Verbose, "verbose-detect", false,
+		"generate a Verbose method")
+	flags.BoolVar(&c.g.DirectlyTested, "direct-detect", false,
+		"generate a DirectlyTested method reporting whether the "+
+			"detector's own package is under test")
+	flags.BoolVar(&c.g.RunFilter, "run-detect", false,
+		"generate a RunFilter method")
+	flags.BoolVar(&c.g.TestName, "name-detect", false,
+		"generate a TestName method")
+	flags.BoolVar(&c.g.TestPath, "path-detect", false,
+		"generate a TestPath method")
+	flags.BoolVar(&c.g.Iteration, "iteration-detect", false,
+		"generate an Iteration method counting the runs of each "+
+			"registered test, as with go test -count")
+	flags.BoolVar(&c.g.OnTesting, "on-testing", false,
+		"generate an OnTesting method registering functions to run at "+
+			"startup in test binaries only")
+	flags.BoolVar(&c.g.OnTestingContext, "ctx", false,
+		"pass the functions registered with OnTesting a context "+
+			"cancelled when test binaries exit")
+	flags.BoolVar(&c.g.CleanupOnTesting, "cleanup-on-testing", false,
+		"generate a CleanupOnTesting method registering functions to run "+
+			"when test binaries exit")
+	flags.BoolVar(&c.g.ModeMethod, "mode-detect", false,
+		"generate a Mode method reporting what the other optional "+
+			"methods would, all at once")
+	flags.BoolVar(&c.g.Assert, "assert", false,
+		"generate a test helper asserting the detector method reports true")
+	flags.BoolVar(&c.g.Stub, "stub", false,
+		"write an always-false stand-in for the detector type, so the "+
+			"package builds before the detector is generated")
+	flags.BoolVar(&c.g.Force, "force", false,
+		"overwrite files with the generated names even if testdetect "+
+			"did not write them")
+	flags.BoolVar(&c.g.Verify, "verify", false,
+		"build each package and its tests after generating into it")
+	flags.StringVar(&c.g.Compiler, "compiler", "",
+		"go, tinygo or gccgo binary that -verify builds with "+
+			"(default $GOCOMPILER, or go)")
+	flags.BoolVar(&c.g.AssertNoTesting, "assert-no-testing", false,
+		"build each main package after generating into it and fail if the "+
+			"program binary links the testing package (requires -no-tamper)")
+	flags.BoolVar(&c.check, "check", false,
+		"report stale generated files instead of writing them")
+	flags.BoolVar(&c.diff, "diff", false,
+		"like -check, but print a unified diff of the changes "+
+			"instead of the paths of stale files")
+	flags.BoolVar(&c.strict, "strict", false,
+		"report generated files declaring other detector methods than "+
+			"configured instead of generating")
+	flags.BoolVar(&c.lint, "lint", false,
+		"report shadowed and unused detector variables instead of "+
+			"generating")
+	flags.BoolVar(&c.dryRun, "n", false,
+		"print the changes that would be made without making them")
+	flags.BoolVar(&c.dryRun, "dry-run", false, "same as -n")
+	flags.BoolVar(&c.watching, "watch", false,
+		"keep running, and generate again whenever the Go files of the "+
+			"packages change")
+	flags.BoolVar(&c.emit, "stdout", false,
+		"print the generated files instead of writing them, framed as a "+
+			"txtar archive if there is more than one")
+	flags.BoolVar(&c.recursive, "r", false,
+		"generate into every package in and below the current directory "+
+			"that uses the detector, as if by the pattern ./...")
+	flags.BoolVar(&c.g.SkipInvalid, "skip-invalid", false,
+		"with package patterns, skip packages that do not parse "+
+			"instead of failing")
+	flags.BoolVar(&workspace, "workspace", false,
+		"like -r, but in every module of the enclosing go.work")
+	flags.BoolVar(&cache, "cache", false,
+		"remember scan results in the user cache directory and skip "+
+			"packages that have not changed")
+	flags.BoolVar(&verbose, "v", false,
+		"log each step to standard error")
+	flags.BoolVar(&quiet, "quiet", false,
+		"print nothing but errors")
+	flags.BoolVar(&c.jsonOut, "json", false,
+		"print a JSON report of the packages scanned and files considered")
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError{err}
+	}
+	if chdir != "" {
+		return nil, usagef("-C flag must be the first flag")
+	}
+	if err := c.validate(verbose, quiet); err != nil {
+		return nil, err
+	}
+	c.g.Mode = detect.Mode(mode)
+	c.g.Backing = detect.Backing(backing)
+	c.g.Tamper = detect.Tamper(tamper)
+	if err := c.output(verbose, quiet, cache); err != nil {
+		return nil, err
+	}
+	if err := c.plan(flags, workspace); err != nil {
+		return nil, err
+	}
+	for _, j := range c.jobs {
+		if c.dryRun {
+			j.g.DryRun = c.stdout
+		}
+		if c.diff {
+			j.g.Diff = c.stdout
+		}
+	}
+	c.check = c.check || c.diff
+	return c, nil
+}
+
+// validate rejects flags that do not combine with each other or with the
+// subcommand, other than those particular to one mode, which its run method
+// rejects.
+func (c *command) validate(verbose, quiet bool) error {
+	if quiet && (verbose || c.jsonOut) {
+		return usagef("-quiet does not combine with -v or -json")
+	}
+	// The report has no room for lint warnings, and the files printed with
+	// -stdout would end up mixed with it.
+	if c.jsonOut && (c.lint || c.emit) {
+		return usagef("-json does not combine with -lint or -stdout")
 	}
-	data := []byte(fmt.Sprintf(testingDetectorTest, pkg))
-	if pkg == "main" {
-		data = append(data, []byte(testingDetectorTamperProtectionTest)...)
+	if c.name == "test" && (c.check || c.diff || c.lint || c.dryRun) {
+		return usagef("test does not support -check, -lint, or -n")
 	}
-	err = os.WriteFile("testing_detector_test.go", data, 0644)
+	return nil
+}
+
+// output sets up where c logs, caches, and writes its output.
+func (c *command) output(verbose, quiet, cache bool) error {
+	if verbose {
+		c.g.Log = os.Stderr
+	}
+	if cache {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		c.g.CacheDir = filepath.Join(dir, "testdetect")
+	}
+	if quiet {
+		c.stdout, c.stderr = io.Discard, io.Discard
+	}
+	if c.jsonOut && c.name != "stats" {
+		c.g.Report, c.stdout = new(detect.Report), io.Discard
+	}
+	return nil
+}
+
+// report prints the JSON report that -json asks for, if any.
+func (c *command) report() {
+	if c.g.Report == nil {
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	enc.Encode(c.g.Report)
+}
+
+// plan works out the jobs of c from the package patterns left in flags or,
+// without any, from the config file.
+func (c *command) plan(flags *flag.FlagSet, workspace bool) error {
+	patterns := flags.Args()
+	if len(patterns) > 0 {
+		c.recursive = true
+	} else {
+		patterns = []string{"./..."}
+	}
+	dirs := []string{"."}
+	if workspace {
+		var err error
+		if dirs, err = detect.Workspace("."); err != nil {
+			return err
+		}
+		c.recursive = true
+	}
+	if c.g.Subpackage != "" && (c.recursive || c.name != "" || c.lint) {
+		return usagef("-package only supports generating into or " +
+			"checking a single package")
+	}
+	for _, dir := range dirs {
+		c.jobs = append(c.jobs, job{&c.g, dir, patterns})
+	}
+	// Without patterns, a config file lists them, except where a single
+	// package is implied by the subcommand or by go generate.
+	if c.recursive || c.name == "size" || c.g.Subpackage != "" ||
+		os.Getenv("GOFILE") != "" {
+		return nil
+	}
+	return c.configure(flags)
+}
+
+// configure replaces the jobs of c with the targets of the config file, if
+// there is one. Flags set on the command line override it.
+func (c *command) configure(flags *flag.FlagSet) error {
+	path, err := findConfig(".")
+	if err != nil || path == "" {
+		return err
+	}
+	conf, err := readConfig(path)
 	if err != nil {
-		return fmt.Errorf("could not write testing_detector_test.go: %w", err)
+		return err
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	c.jobs = nil
+	for _, t := range conf.Targets {
+		c.jobs = append(c.jobs, job{
+			t.generator(c.g, set), filepath.Dir(path), t.Patterns,
+		})
 	}
+	c.recursive = true
 	return nil
 }
 
-func pkgname(path string) (string, error) {
-	pkgs, err := packages.Load(&packages.Config{Mode: packages.NeedName}, ".")
+// runVersion prints the version of testdetect.
+func runVersion(args []string) error {
+	if len(args) > 0 {
+		return usagef("unexpected arguments %q", args)
+	}
+	fmt.Println("testdetect", detect.Version())
+	return nil
+}
+
+// runSize prints the size of the program binary with and without the
+// detector.
+func (c *command) runSize() error {
+	if c.check || c.dryRun || c.recursive {
+		return usagef("size does not support -check, -n, " +
+			"or package patterns")
+	}
+	sz, err := c.g.Size(".")
 	if err != nil {
-		return "", fmt.Errorf("could not load package in %q: %w", path, err)
+		return err
 	}
-	if len(pkgs) < 1 {
-		return "", fmt.Errorf("could not find packages in %q", path)
+	fmt.Fprintf(c.stdout, "with detector:    %d bytes\n", sz.Detector)
+	fmt.Fprintf(c.stdout, "without detector: %d bytes\n", sz.Baseline)
+	fmt.Fprintf(c.stdout, "delta:            %+d bytes (%+.2f%%)\n",
+		sz.Delta(), sz.Percent())
+	return nil
+}
+
+// runStats prints how the packages of the jobs use the detector.
+func (c *command) runStats() error {
+	if c.check || c.lint || c.dryRun {
+		return usagef("stats does not support -check, -lint, or -n")
 	}
-	var pkgErrs []error
-	for _, pkg := range pkgs {
-		if len(pkg.Errors) > 0 {
-			for _, err := range pkg.Errors {
-				pkgErrs = append(pkgErrs, err)
+	var total detect.Stats
+	for _, j := range c.jobs {
+		patterns := j.patterns
+		if !c.recursive {
+			patterns = []string{"."}
+		}
+		st, err := j.g.Stats(j.dir, patterns...)
+		if err != nil {
+			return err
+		}
+		total.Packages += st.Packages
+		total.Uses += st.Uses
+		total.Calls += st.Calls
+		total.Tampered = append(total.Tampered, st.Tampered...)
+	}
+	if c.jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(total)
+	}
+	fmt.Fprintf(c.stdout, "packages:          %d\n", total.Packages)
+	fmt.Fprintf(c.stdout, "using detector:    %d\n", total.Uses)
+	fmt.Fprintf(c.stdout, "call sites:        %d\n", total.Calls)
+	fmt.Fprintf(c.stdout, "tamper violations: %d\n", len(total.Tampered))
+	for _, path := range total.Tampered {
+		fmt.Fprintf(c.stdout, "\t%s\n", path)
+	}
+	return nil
+}
+
+// runClean removes the generated files of the jobs.
+func (c *command) runClean() error {
+	if c.check {
+		return usagef("clean does not support -check")
+	}
+	var removed int
+	for _, j := range c.jobs {
+		var (
+			paths []string
+			err   error
+		)
+		if c.recursive {
+			paths, err = j.g.CleanAll(j.dir, j.patterns...)
+		} else {
+			paths, err = j.g.Clean(j.dir)
+		}
+		removed += len(paths)
+		if err != nil {
+			return err
+		}
+	}
+	if c.recursive && !c.dryRun {
+		fmt.Fprintf(c.stdout, "removed %d generated files\n", removed)
+	}
+	return nil
+}
+
+// runLint prints the lint warnings for the packages of the jobs.
+func (c *command) runLint() error {
+	if c.check || c.dryRun {
+		return usagef("-lint does not support -check or -n")
+	}
+	var warnings []string
+	for _, j := range c.jobs {
+		var (
+			found []string
+			err   error
+		)
+		if c.recursive {
+			found, err = j.g.LintAll(j.dir, j.patterns...)
+		} else {
+			found, err = j.g.Lint(j.dir)
+		}
+		if err != nil {
+			return err
+		}
+		warnings = append(warnings, found...)
+	}
+	for _, w := range warnings {
+		fmt.Fprintln(c.stdout, w)
+	}
+	if len(warnings) > 0 {
+		return fmt.Errorf("found %d detector lint warnings",
+			len(warnings))
+	}
+	return nil
+}
+
+// runStrict reports generated files that declare other methods than the
+// jobs configure.
+func (c *command) runStrict() error {
+	if c.name == "test" || c.check || c.dryRun || c.emit || c.watching {
+		return usagef("-strict does not support test, -check, -n, " +
+			"-stdout, or -watch")
+	}
+	var errs []error
+	for _, j := range c.jobs {
+		var err error
+		if c.recursive {
+			err = j.g.StrictAll(j.dir, j.patterns...)
+		} else {
+			err = j.g.Strict(j.dir)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// runCheck prints the generated files of the jobs that are out of date,
+// or with -diff, the changes that would bring them up to date.
+func (c *command) runCheck() error {
+	var stale []string
+	for _, j := range c.jobs {
+		var (
+			paths []string
+			err   error
+		)
+		if c.recursive {
+			paths, err = j.g.CheckAll(j.dir, j.patterns...)
+		} else {
+			paths, err = j.g.Check(j.dir)
+		}
+		if err != nil {
+			return err
+		}
+		stale = append(stale, paths...)
+	}
+	if !c.diff {
+		for _, path := range stale {
+			fmt.Fprintln(c.stdout, path)
+		}
+	}
+	if len(stale) > 0 {
+		return errors.New("generated files are out of date")
+	}
+	return nil
+}
+
+// runWatch generates for the jobs, then again whenever their packages
+// change, until interrupted.
+func (c *command) runWatch() error {
+	if c.name != "" || c.lint || c.check || c.dryRun || c.emit {
+		return usagef("-watch only supports generating")
+	}
+	var dirs []string
+	for _, j := range c.jobs {
+		dirs = append(dirs, j.dir)
+	}
+	generate := func() error {
+		if !c.recursive {
+			return c.g.Generate(".")
+		}
+		var errs []error
+		for _, j := range c.jobs {
+			_, err := j.g.GenerateAll(j.dir, j.patterns...)
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return watch(ctx, dirs, c.recursive, generate, c.stderr)
+}
+
+// runStdout prints the files the jobs would generate instead of writing
+// them.
+func (c *command) runStdout() error {
+	if c.name != "" || c.lint || c.check || c.dryRun {
+		return usagef("-stdout only supports generating")
+	}
+	var (
+		buf                bytes.Buffer
+		generated, skipped int
+	)
+	for _, j := range c.jobs {
+		j.g.Emit = &buf
+		if !c.recursive {
+			if err := j.g.Generate("."); err != nil {
+				return err
 			}
+			generated++
 			continue
 		}
-		return pkg.Name, nil
+		sum, err := j.g.GenerateAll(j.dir, j.patterns...)
+		if err != nil {
+			return err
+		}
+		generated += len(sum.Generated)
+		skipped += len(sum.Skipped)
 	}
-	return "", errors.Join(
-		append(
-			[]error{fmt.Errorf("could not load package in %q", path)},
-			pkgErrs...,
-		)...,
+	if generated == 0 {
+		return noDetectorError{c.g.Type, skipped}
+	}
+	return writeArchive(os.Stdout, buf.Bytes())
+}
+
+// runGenerate generates into the packages of the jobs, and for the test
+// subcommand, runs their tests.
+func (c *command) runGenerate() error {
+	if !c.recursive {
+		return c.generateOne()
+	}
+	var (
+		generated, skipped int
+		types              []string
+		tests              = make([][]string, len(c.jobs))
 	)
+	for i, j := range c.jobs {
+		sum, err := j.g.GenerateAll(j.dir, j.patterns...)
+		if err != nil {
+			return err
+		}
+		tests[i] = sum.Generated
+		generated += len(sum.Generated)
+		skipped += len(sum.Skipped)
+		for _, err := range sum.Invalid {
+			fmt.Fprintf(c.stderr, "warning: skipped: %s\n", err)
+		}
+		if !slices.Contains(types, j.g.Type) {
+			types = append(types, j.g.Type)
+		}
+	}
+	typ := strings.Join(types, " or ")
+	if generated == 0 {
+		return noDetectorError{typ, skipped}
+	}
+	fmt.Fprintf(c.stdout, "generated %d packages, skipped %d without %s\n",
+		generated, skipped, typ)
+	if c.name != "test" {
+		return nil
+	}
+	for i, j := range c.jobs {
+		if len(tests[i]) == 0 {
+			continue
+		}
+		if err := goTest(j.dir, tests[i], c.stdout, c.stderr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateOne generates into the current package, or under go generate,
+// into the package of the file with the directive, reporting errors at the
+// directive.
+func (c *command) generateOne() error {
+	file := os.Getenv("GOFILE")
+	if file == "" {
+		if err := c.g.Generate("."); err != nil || c.name != "test" {
+			return err
+		}
+		return goTest(".", []string{"."}, c.stdout, c.stderr)
+	}
+	c.g.Package = os.Getenv("GOPACKAGE")
+	if err := c.g.Generate(filepath.Dir(file)); err != nil {
+		return fmt.Errorf("%s:%s: %w", file, os.Getenv("GOLINE"), err)
+	}
+	return nil
+}
+
+// writeArchive writes the files of the txtar archive data to w in path
+// order, framed as an archive again unless there is only one, which is
+// written as is.
+func writeArchive(w io.Writer, data []byte) error {
+	ar := txtar.Parse(data)
+	slices.SortStableFunc(ar.Files, func(a, b txtar.File) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(ar.Files) == 1 {
+		_, err := w.Write(ar.Files[0].Data)
+		return err
+	}
+	_, err := w.Write(txtar.Format(ar))
+	return err
+}
+
+// goTest runs go test in dir on the packages in the directories pkgs,
+// passing its output through.
+func goTest(dir string, pkgs []string, stdout, stderr io.Writer) error {
+	args := []string{"test"}
+	for _, pkg := range pkgs {
+		// The directories are relative to the current one, not dir, and
+		// go test would take some relative ones for import paths.
+		pkg, err := filepath.Abs(pkg)
+		if err != nil {
+			return err
+		}
+		args = append(args, pkg)
+	}
+	cmd := exec.Command("go", args...)
+	cmd.Dir, cmd.Stdout, cmd.Stderr = dir, stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go test failed: %w", err)
+	}
+	return nil
+}
+
+// changeDir applies a leading -C flag, as the go command does, and returns
+// the remaining arguments.
+func changeDir(args []string) ([]string, error) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "-") {
+		return args, nil
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(args[0], "-"), "-")
+	dir, ok := strings.CutPrefix(name, "C=")
+	rest := args[1:]
+	switch {
+	case name == "C":
+		if len(rest) == 0 {
+			return nil, usagef("flag needs an argument: -C")
+		}
+		dir, rest = rest[0], rest[1:]
+	case !ok:
+		return args, nil
+	}
+	if err := os.Chdir(dir); err != nil {
+		return nil, err
+	}
+	return rest, nil
 }
@@ -2,17 +2,2052 @@ package main
 
 import (
 	"bytes"
-	"cmp"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/tools/txtar"
+	"lesiw.io/testdetect/detect"
 )
 
-func TestSimple(t *testing.T) {
+func TestSimple(t *testing.T) { testSimple(t) }
+
+func TestTinyGo(t *testing.T) {
+	tinygo, err := exec.LookPath("tinygo")
+	if err != nil {
+		t.Skip("tinygo not installed")
+	}
+	t.Setenv("GOCOMPILER", tinygo)
+	testSimple(t)
+	runBinaries(t)
+}
+
+func TestGccgo(t *testing.T) {
+	gccgo, err := exec.LookPath("gccgo")
+	if err != nil {
+		t.Skip("gccgo not installed")
+	}
+	t.Setenv("GOCOMPILER", gccgo)
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("t.Testing()=true")
+	} else {
+		println("t.Testing()=false")
+	}
+}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	// gccgo's standard library predates testing.Testing, which the tamper
+	// check calls.
+	if err := run("-no-tamper"); err != nil {
+		t.Fatalf("run(-no-tamper) = %q, want <nil>", err.Error())
+	}
+	if _, _, err := buildBinaries(); err != nil {
+		t.Fatal(err)
+	}
+	// gccgo does not remove the dead branches, so only check behavior.
+	runBinaries(t)
+}
+
+func TestGccgoTesting(t *testing.T) {
+	chTempDir(t)
+	// Generation only looks at the name, so gccgo need not be installed.
+	t.Setenv("GOCOMPILER", filepath.Join(t.TempDir(), "gccgo"))
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() { println(t.Testing()) }
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	err := run()
+	if err == nil || !strings.Contains(err.Error(), "testing.Testing") {
+		t.Errorf("run() under gccgo = %v, want testing.Testing error", err)
+	}
+	if err := run("-no-tamper"); err != nil {
+		t.Errorf("run(-no-tamper) under gccgo = %q, want <nil>", err)
+	}
+	if err := run("-go=1.20"); err != nil {
+		t.Errorf("run(-go=1.20) under gccgo = %q, want <nil>", err)
+	}
+
+	var lib = []byte(`package lib
+
+var t testingDetector
+
+func Testing() bool { return t.Testing() }
+`)
+	if err := os.Mkdir("lib", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("lib/lib.go", lib, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = run("-no-tamper", "./lib")
+	if err == nil || !strings.Contains(err.Error(), "testing.Testing") {
+		t.Errorf("run(-no-tamper ./lib) under gccgo = %v, "+
+			"want testing.Testing error", err)
+	}
+}
+
+// runBinaries runs the binaries built by buildBinaries for a program that
+// prints the result of t.Testing().
+func runBinaries(t *testing.T) {
+	t.Helper()
+	for bin, want := range map[string]string{
+		"./" + outBin:     "t.Testing()=false",
+		"./" + outTestBin: "t.Testing()=true",
+	} {
+		out, err := exec.Command(bin).CombinedOutput()
+		if err != nil {
+			t.Errorf("%s failed: %s\n%s", bin, err, out)
+		} else if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("%s output did not contain %q\n%s", bin, want, out)
+		}
+	}
+}
+
+func testSimple(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("t.Testing()=true")
+	} else {
+		println("t.Testing()=false")
+	}
+	println("Hello world!")
+}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	bin, testbin, err := buildBinaries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := "Hello world!"; !bytes.Contains(bin, []byte(s)) {
+		t.Errorf("missing %q in program binary", s)
+	}
+	if s := "t.Testing()=true"; bytes.Contains(bin, []byte(s)) {
+		t.Errorf("found %q in program binary", s)
+	}
+	if s := "t.Testing()=false"; !bytes.Contains(bin, []byte(s)) {
+		t.Errorf("missing %q in program binary", s)
+	}
+
+	if s := "Hello world!"; !bytes.Contains(testbin, []byte(s)) {
+		t.Errorf("missing %q in test binary", s)
+	}
+	if s := "t.Testing()=true"; !bytes.Contains(testbin, []byte(s)) {
+		t.Errorf("missing %q in test binary", s)
+	}
+	if s := "t.Testing()=false"; bytes.Contains(testbin, []byte(s)) {
+		t.Errorf("found %q in test binary", s)
+	}
+}
+
+func TestTamperDetection(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	var tamper = []byte(`package main
+
+func (t testingDetector) Testing() bool { return true }
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("tamper.go", tamper, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	err := run()
+	if want := "method testingDetector.Testing overrides the generated " +
+		"detector"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("run() = %v, want error containing %q", err, want)
+	}
+
+	// Tampering after generation is caught when building instead.
+	if err := os.Rename("tamper.go", "tamper.go.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	if err := os.Rename("tamper.go.txt", "tamper.go"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("go", "build", "-o", os.DevNull, ".").
+		CombinedOutput()
+	if err == nil {
+		t.Fatal("go build . successful, want error")
+	}
+	wantErr := []byte("ambiguous selector testingDetectorProbe.Testing")
+	if !bytes.Contains(out, wantErr) {
+		t.Errorf("go build output did not contain %q\n%s",
+			string(wantErr), out)
+	}
+
+}
+
+// setUpTamper generates the detector with args into a main package in a
+// new temporary directory, then adds a file declaring the detector method
+// on the generated type that the detector embeds, which the compiler
+// cannot catch.
+func setUpTamper(t *testing.T, args ...string) {
+	t.Helper()
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run(args...); err != nil {
+		t.Fatalf("run(%q) = %q, want <nil>", args, err.Error())
+	}
+	var tamper = []byte(`package main
+
+func (testingDetectorOverride) Testing() bool { return true }
+`)
+	if err := os.WriteFile("tamper.go", tamper, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTamperCheck(t *testing.T) {
+	setUpTamper(t)
+	out, err := exec.Command("go", "run", ".").CombinedOutput()
+	if err == nil {
+		t.Fatal("go run . successful, want panic")
+	} else if ee := new(exec.ExitError); !errors.As(err, &ee) {
+		t.Fatalf("go run failed unexpectedly: %s", err)
+	}
+	wantErr := []byte("bad testingDetector state: got true, want false")
+	if !bytes.Contains(out, wantErr) {
+		t.Errorf("go run output did not contain %q\n%s", string(wantErr), out)
+	}
+}
+
+func TestTamperMsg(t *testing.T) {
+	msg := "{{.Type}}.{{.Method}}() = {{.Got}}, want {{.Want}} (100% sure)"
+	setUpTamper(t, "-tamper-msg="+msg)
+	out, err := exec.Command("go", "run", ".").CombinedOutput()
+	if err == nil {
+		t.Fatal("go run . successful, want panic")
+	}
+	wantErr := []byte("testingDetector.Testing() = true, want false " +
+		"(100% sure)")
+	if !bytes.Contains(out, wantErr) {
+		t.Errorf("go run output did not contain %q\n%s", string(wantErr), out)
+	}
+	if err := os.Remove("tamper.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("-tamper-msg={{.Bogus}}"); err == nil {
+		t.Error("run(-tamper-msg={{.Bogus}}) = <nil>, want error")
+	}
+}
+
+func TestTamperLog(t *testing.T) {
+	// In log mode, the program reports the tampering and keeps running.
+	setUpTamper(t, "-tamper=log")
+	out, err := exec.Command("go", "run", ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run . failed: %s\n%s", err, out)
+	}
+	wantErr := []byte("bad testingDetector state: got true, want false\n")
+	if !bytes.Contains(out, wantErr) {
+		t.Errorf("go run output did not contain %q\n%s", string(wantErr), out)
+	}
+	err = run("-tamper=ignore")
+	if want := `bad tamper action "ignore"`; err == nil ||
+		!strings.Contains(err.Error(), want) {
+		t.Errorf("run(-tamper=ignore) = %v, want error containing %q",
+			err, want)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	files := []string{"testing_detector.go", "testing_detector_test.go"}
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range files {
+		if err := os.Chtimes(name, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := run(); err != nil {
+		t.Fatalf("second run() = %q, want <nil>", err.Error())
+	}
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.ModTime(); !got.Equal(past) {
+			t.Errorf("%s modified at %s, want %s", name, got, past)
+		}
+	}
+	if err := run("-short-detect"); err != nil {
+		t.Fatalf("run(-short-detect) = %q, want <nil>", err.Error())
+	}
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.ModTime(); got.Equal(past) {
+			t.Errorf("%s not modified by run(-short-detect)", name)
+		}
+	}
+}
+
+func TestCleanCommand(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	if err := run("clean"); err != nil {
+		t.Fatalf("run(clean) = %q, want <nil>", err.Error())
+	}
+	for _, name := range []string{
+		"testing_detector.go",
+		"testing_detector_test.go",
+	} {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("run(clean) left %s", name)
+		}
+	}
+	if _, err := os.Stat("main.go"); err != nil {
+		t.Errorf("could not stat main.go: %s", err)
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	out, err := exec.Command("go", "run", ".", "version").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run . version failed: %s\n%s", err, out)
+	}
+	version, ok := bytes.CutPrefix(bytes.TrimSpace(out), []byte("testdetect "))
+	if !ok || len(version) == 0 {
+		t.Errorf("go run . version = %q, want testdetect <version>", out)
+	}
+	if err := run("version", "extra"); err == nil {
+		t.Error("run(version extra) = <nil>, want error")
+	}
+}
+
+func TestJSONFlag(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	err := os.WriteFile(filepath.Join(dir, "main.go"), program, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	out, err := exec.Command("go", "run", ".", "-C", dir, "-n", "-json").
+		Output()
+	if err != nil {
+		t.Fatalf("go run . -n -json failed: %s\n%s", err, out)
+	}
+	var report detect.Report
+	if err := json.Unmarshal(out, &report); err != nil {
+		t.Fatalf("could not parse report: %s\n%s", err, out)
+	}
+	want := []detect.ReportFile{
+		{Path: "testing_detector.go", Action: "create"},
+		{Path: "testing_detector_test.go", Action: "create"},
+	}
+	if !slices.Equal(report.Files, want) {
+		t.Errorf("report.Files = %v, want %v", report.Files, want)
+	}
+	if len(report.Packages) != 1 || !slices.Equal(report.Packages[0].Vars,
+		[]string{"t"}) {
+		t.Errorf("report.Packages = %v, want one package with var t",
+			report.Packages)
+	}
+	for _, flag := range []string{"-lint", "-stdout"} {
+		err := run("-json", flag)
+		if err == nil || exitCode(err) != exitUsage {
+			t.Errorf("run(-json, %s) = %v, want usage error", flag, err)
+		}
+	}
+}
+
+func TestStdoutFlag(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	err := os.WriteFile(filepath.Join(dir, "main.go"), program, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	out, err := exec.Command("go", "run", ".", "-C", dir, "-stdout").Output()
+	if err != nil {
+		t.Fatalf("go run . -stdout failed: %s\n%s", err, out)
+	}
+	ar := txtar.Parse(out)
+	var names []string
+	for _, f := range ar.Files {
+		names = append(names, f.Name)
+	}
+	want := []string{"testing_detector.go", "testing_detector_test.go"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("archive files = %q, want %q\n%s", names, want, out)
+	}
+	method := []byte("func (t testingDetectorOverride) Testing() bool")
+	if test := ar.Files[1].Data; !bytes.Contains(test, method) {
+		t.Errorf("%s did not contain %q\n%s", names[1], method, test)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("-stdout wrote %s", name)
+		}
+	}
+
+	// A single file is printed without framing.
+	out, err = exec.Command("go", "run", ".", "-C", dir, "-stdout", "-stub").
+		Output()
+	if err != nil {
+		t.Fatalf("go run . -stdout -stub failed: %s\n%s", err, out)
+	}
+	if want := []byte("// Code generated"); !bytes.HasPrefix(out, want) {
+		t.Errorf("go run . -stdout -stub output does not begin with %q\n%s",
+			want, out)
+	}
+	method = []byte("func (testingDetector) Testing() bool")
+	if !bytes.Contains(out, method) {
+		t.Errorf("go run . -stdout -stub output did not contain %q\n%s",
+			method, out)
+	}
+}
+
+func TestWatchFlag(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	writeFile := func(name string, data []byte) {
+		t.Helper()
+		err := os.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("main.go", program)
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	log := startWatch(t, dir, "-watch", "-v")
+	detector := filepath.Join(dir, "testing_detector.go")
+	waitFor(t, log, "first generation",
+		contains(detector, "type testingDetector"))
+
+	// A new constraint on the file using the detector is propagated.
+	writeFile("main.go", append([]byte("//go:build !plan9\n\n"), program...))
+	waitFor(t, log, "regeneration", contains(detector, "//go:build !plan9"))
+	info, err := os.Stat(detector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A change that does not affect the output leaves it alone.
+	writeFile("extra.go", []byte("package main\n"))
+	waitFor(t, log, "unchanged regeneration",
+		contains(log, "unchanged testing_detector.go"))
+	if after, err := os.Stat(detector); err != nil {
+		t.Fatal(err)
+	} else if !after.ModTime().Equal(info.ModTime()) {
+		t.Errorf("-watch rewrote %s though it did not change", detector)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir := t.TempDir()
+	var config = []byte(`{"targets": [
+	{"patterns": ["./a/..."]},
+	{"patterns": ["./b/..."], "type": "otherDetector"}
+]}
+`)
+	files := map[string]string{
+		"testdetect.json": string(config),
+		"a/a.go":          "package a\n\nvar t testingDetector\n",
+		"b/b.go":          "package b\n\nvar t otherDetector\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	log := startWatch(t, dir, "-watch")
+	a := filepath.Join(dir, "a", "testing_detector.go")
+	b := filepath.Join(dir, "b", "other_detector.go")
+	waitFor(t, log, "generation into a", contains(a, "type testingDetector"))
+	waitFor(t, log, "generation into b", contains(b, "type otherDetector"))
+
+	// Every target's packages are watched, not only the current directory.
+	src := "//go:build !plan9\n\npackage b\n\nvar t otherDetector\n"
+	err := os.WriteFile(filepath.Join(dir, "b", "b.go"), []byte(src), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, log, "regeneration into b", contains(b, "//go:build !plan9"))
+}
+
+// startWatch builds testdetect and starts it in dir with args until the
+// test finishes, returning the path of the file it logs to.
+func startWatch(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	td := filepath.Join(t.TempDir(), exe("testdetect"))
+	if out, err := exec.Command("go", "build", "-o", td, ".").
+		CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %s\n%s", err, out)
+	}
+	log, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.Close() })
+	cmd := exec.Command(td, args...)
+	cmd.Dir, cmd.Stderr = dir, log
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return log.Name()
+}
+
+// waitFor fails the test unless ok reports true within a timeout, showing
+// the contents of the file log if it does not.
+func waitFor(t *testing.T, log, what string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(30 * time.Second); !ok(); {
+		if time.Now().After(deadline) {
+			data, _ := os.ReadFile(log)
+			t.Fatalf("timed out waiting for %s\n%s", what, data)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// contains returns a function reporting whether the file at path contains
+// s.
+func contains(path, s string) func() bool {
+	return func() bool {
+		data, err := os.ReadFile(path)
+		return err == nil && bytes.Contains(data, []byte(s))
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	td := filepath.Join(t.TempDir(), exe("testdetect"))
+	if out, err := exec.Command("go", "build", "-o", td, ".").
+		CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %s\n%s", err, out)
+	}
+	var detector = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	for _, tt := range []struct {
+		name  string
+		files map[string][]byte
+		args  []string
+		code  int
+	}{{
+		name:  "success",
+		files: map[string][]byte{"main.go": detector},
+		args:  []string{"-r"},
+		code:  0,
+	}, {
+		name:  "usage",
+		files: map[string][]byte{"main.go": detector},
+		args:  []string{"-no-such-flag"},
+		code:  exitUsage,
+	}, {
+		name:  "bad flag value",
+		files: map[string][]byte{"main.go": detector},
+		args:  []string{"-type=1x"},
+		code:  exitUsage,
+	}, {
+		name: "no detector",
+		files: map[string][]byte{"main.go": []byte(`package main
+
+func main() {}
+`)},
+		args: []string{"-r"},
+		code: exitNoDetector,
+	}, {
+		name: "tamper",
+		files: map[string][]byte{"main.go": append(detector, `
+func (t testingDetector) Testing() bool { return true }
+`...)},
+		code: exitTamper,
+	}, {
+		name: "conflict",
+		files: map[string][]byte{
+			"main.go":             detector,
+			"testing_detector.go": []byte("package main\n"),
+		},
+		code: exitConflict,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+			cmd.Dir = dir
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("go mod init failed: %s\n%s", err, out)
+			}
+			var stdout, stderr bytes.Buffer
+			cmd = exec.Command(td, append([]string{"-quiet"}, tt.args...)...)
+			cmd.Dir, cmd.Stdout, cmd.Stderr = dir, &stdout, &stderr
+			err := cmd.Run()
+			var exit *exec.ExitError
+			if err != nil && !errors.As(err, &exit) {
+				t.Fatal(err)
+			}
+			if got := cmd.ProcessState.ExitCode(); got != tt.code {
+				t.Errorf("exit code = %d, want %d\n%s",
+					got, tt.code, stderr.Bytes())
+			}
+			if stdout.Len() > 0 {
+				t.Errorf("-quiet printed %q", stdout.Bytes())
+			}
+			if got := stderr.Len() > 0; got != (tt.code != 0) {
+				t.Errorf("stderr = %q, want output only on failure",
+					stderr.Bytes())
+			}
+		})
+	}
+}
+
+func TestSizeCommand(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("t.Testing()=true")
+	}
+}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("size"); err != nil {
+		t.Fatalf("run(size) = %q, want <nil>", err)
+	}
+	if _, err := os.Stat("testing_detector.go"); err == nil {
+		t.Error("run(size) wrote testing_detector.go")
+	}
+	size, err := (&detect.Generator{NoTamper: true}).Size(".")
+	if err != nil {
+		t.Fatalf("Size(.) = %q, want <nil>", err)
+	}
+	if size.Percent() > 1 {
+		t.Errorf("Size(.) = %d bytes over a %d byte baseline, want <1%%",
+			size.Delta(), size.Baseline)
+	}
+}
+
+func TestSkipInvalid(t *testing.T) {
+	chTempDir(t)
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	for path, src := range map[string]string{
+		"good/good.go": "package good\n\nvar t testingDetector\n",
+		"bad/bad.go":   "package bad\n\nvar t testingDetector\n\nfunc f() {\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := run("-r")
+	if err == nil {
+		t.Fatal("run(-r) = <nil>, want error")
+	}
+	if want := filepath.Join("bad", "bad.go") + ":5:12:"; !strings.Contains(
+		err.Error(), want) {
+		t.Errorf("run(-r) = %q, want error at %s", err, want)
+	}
+	if _, err := os.Stat("good/testing_detector.go"); err == nil {
+		t.Error("run(-r) generated into good despite the error")
+	}
+	if err := run("-r", "-skip-invalid"); err != nil {
+		t.Fatalf("run(-r -skip-invalid) = %q, want <nil>", err)
+	}
+	if _, err := os.Stat("good/testing_detector.go"); err != nil {
+		t.Errorf("run(-r -skip-invalid) did not generate into good: %s",
+			err)
+	}
+	if _, err := os.Stat("bad/testing_detector.go"); err == nil {
+		t.Error("run(-r -skip-invalid) generated into bad")
+	}
+}
+
+func TestStatsCommand(t *testing.T) {
+	dir := writeStatsModule(t)
+	out, err := exec.Command("go", "run", ".", "-C", dir, "stats", "-json",
+		"./...").Output()
+	if err != nil {
+		t.Fatalf("go run . stats -json ./... failed: %s\n%s", err, out)
+	}
+	var stats detect.Stats
+	if err := json.Unmarshal(out, &stats); err != nil {
+		t.Fatalf("could not parse stats: %s\n%s", err, out)
+	}
+	if stats.Packages != 3 || stats.Uses != 2 || stats.Calls != 3 {
+		t.Errorf("stats = %+v, want 3 packages, 2 using, 3 calls", stats)
+	}
+	if want := []string{"example.com/pkg/lib"}; !slices.Equal(
+		stats.Tampered, want) {
+		t.Errorf("stats.Tampered = %q, want %q", stats.Tampered, want)
+	}
+	out, err = exec.Command("go", "run", ".", "-C", dir, "stats", "./...").
+		Output()
+	if err != nil {
+		t.Fatalf("go run . stats ./... failed: %s\n%s", err, out)
+	}
+	for _, line := range []string{
+		"packages:          3\n",
+		"using detector:    2\n",
+		"call sites:        3\n",
+		"tamper violations: 1\n\texample.com/pkg/lib\n",
+	} {
+		if !bytes.Contains(out, []byte(line)) {
+			t.Errorf("stats output did not contain %q\n%s", line, out)
+		}
+	}
+	for _, name := range []string{
+		"testing_detector.go",
+		"lib/testing_detector.go",
+	} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("stats wrote %s", path)
+		}
+	}
+}
+
+// writeStatsModule writes a module for the stats command to count in a
+// new temporary directory, which it returns: a main package calling the
+// detector thrice, a library that tampers with it, and a package that does
+// not use it.
+func writeStatsModule(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	for path, src := range map[string]string{
+		"main.go": `package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("test")
+	}
+	println(t.Testing())
+}
+`,
+		"main_test.go": `package main
+
+import "testing"
+
+func TestMain(tt *testing.T) { tt.Log(t.Testing()) }
+`,
+		"lib/lib.go": `package lib
+
+var t testingDetector
+
+func Testing() bool { return t.Testing() }
+
+func (testingDetector) Testing() bool { return true }
+`,
+		"none/none.go": "package none\n",
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestGoGenerate(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+//go:generate testdetect
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	t.Setenv("GOFILE", "main.go")
+	t.Setenv("GOLINE", "3")
+	t.Setenv("GOPACKAGE", "other")
+	err := run()
+	if err == nil || !strings.HasPrefix(err.Error(), "main.go:3: ") {
+		t.Errorf("run() with GOPACKAGE=other = %v, "+
+			"want error at main.go:3", err)
+	}
+	t.Setenv("GOPACKAGE", "main")
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	if _, err := os.Stat("testing_detector.go"); err != nil {
+		t.Errorf("could not stat testing_detector.go: %s", err)
+	}
+}
+
+func TestChdirFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	chdir(t, "pkg")
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	chdir(t, "..")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run("-C", "pkg"); err != nil {
+		t.Fatalf("run(-C pkg) = %q, want <nil>", err.Error())
+	}
+	if _, err := os.Stat(wd + "/pkg/testing_detector.go"); err != nil {
+		t.Errorf("could not stat pkg/testing_detector.go: %s", err)
+	}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("-C=pkg", "-check"); err != nil {
+		t.Errorf("run(-C=pkg -check) = %q, want <nil>", err.Error())
+	}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("-check", "-C", "pkg"); err == nil {
+		t.Error("run(-check -C pkg) = <nil>, want error")
+	}
+}
+
+func TestPointerDetector(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t *testingDetector
+
+func main() { println("t.Testing() =", t.Testing()) }
+`)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	out, err := exec.Command("go", "run", ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run failed: %s\n%s", err, string(out))
+	}
+	if want := []byte("t.Testing() = false"); !bytes.Contains(out, want) {
+		t.Errorf("go run output did not contain %q\n%s", want, out)
+	}
+	out, err = exec.Command("go", "test", "-v", ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go test failed: %s\n%s", err, string(out))
+	}
+	if want := []byte("t.Testing() = true"); !bytes.Contains(out, want) {
+		t.Errorf("go test output did not contain %q\n%s", want, out)
+	}
+
+	var tamper = []byte(`package main
+
+func (t *testingDetector) Testing() bool { return true }
+`)
+	if err := os.WriteFile("tamper.go", tamper, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command("go", "run", ".").CombinedOutput()
+	if err == nil {
+		t.Fatal("go run . successful, want build failure")
+	} else if ee := new(exec.ExitError); !errors.As(err, &ee) {
+		t.Fatalf("go run failed unexpectedly: %s", err)
+	}
+	wantErr := []byte("method testingDetector.Testing already declared")
+	if !bytes.Contains(out, wantErr) {
+		t.Errorf("go run output did not contain %q\n%s", string(wantErr), out)
+	}
+}
+
+func TestVerifyFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func (testingDetectorEmbed) Testing() bool { return true }
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	err := run("-verify")
+	if err == nil {
+		t.Fatal("run(-verify) = <nil>, want error")
+	}
+	if !strings.HasPrefix(err.Error(), "testing_detector.go: ") {
+		t.Errorf("run(-verify) = %q, want error naming the file", err)
+	}
+	if !strings.Contains(err.Error(), "already declared") {
+		t.Errorf("run(-verify) = %q, want compiler output", err)
+	}
+}
+
+func TestAssertNoTestingFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("t.Testing()=true")
+	}
+}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("-assert-no-testing"); err == nil {
+		t.Error("run(-assert-no-testing) = <nil>, want error")
+	}
+	err := run("-no-tamper", "-assert-no-testing", "-compiler=tinygo")
+	if err == nil || !strings.Contains(err.Error(), "tinygo") {
+		t.Errorf("run(-no-tamper -assert-no-testing -compiler=tinygo) = %v, "+
+			"want error naming tinygo", err)
+	}
+	if err := run("-no-tamper", "-assert-no-testing"); err != nil {
+		t.Fatalf("run(-no-tamper -assert-no-testing) = %q, want <nil>", err)
+	}
+	if _, _, err := buildBinaries(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("go", "tool", "nm", outBin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool nm failed: %s\n%s", err, out)
+	}
+	if s := " testing."; bytes.Contains(out, []byte(s)) {
+		t.Errorf("found %q in program binary symbols\n%s", s, out)
+	}
+
+	var leak = []byte(`package main
+
+import "testing"
+
+var _ = testing.Verbose
+`)
+	if err := os.WriteFile("leak.go", leak, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = run("-no-tamper", "-assert-no-testing")
+	if err == nil || !strings.Contains(err.Error(), "testing.") {
+		t.Errorf("run(-no-tamper -assert-no-testing) = %v, "+
+			"want error listing testing symbols", err)
+	}
+}
+
+func TestNoTamperFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.Testing() {
+		println("t.Testing()=true")
+	}
+	println("Hello world!")
+}
+`)
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(_ *testing.T) { main() }
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	build := func(name string, args ...string) []byte {
+		t.Helper()
+		if err := run(args...); err != nil {
+			t.Fatalf("run(%q) = %q, want <nil>", args, err.Error())
+		}
+		out, err := exec.Command("go", "build", "-o", name).CombinedOutput()
+		if err != nil {
+			t.Fatalf("go build failed: %s\n%s", err, out)
+		}
+		bin, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bin
+	}
+	tamper, plain := build("tamper"), build("plain", "-no-tamper")
+	if len(plain) >= len(tamper) {
+		t.Errorf("-no-tamper binary is %d bytes, want fewer than %d",
+			len(plain), len(tamper))
+	}
+	msg := []byte("bad testingDetector state")
+	if !bytes.Contains(tamper, msg) {
+		t.Errorf("default binary does not contain %q", msg)
+	}
+	if bytes.Contains(plain, msg) {
+		t.Errorf("-no-tamper binary contains %q", msg)
+	}
+	out, err := exec.Command("go", "tool", "nm", "plain").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go tool nm failed: %s\n%s", err, out)
+	}
+	if sym := []byte("testingDetectorInit"); bytes.Contains(out, sym) {
+		t.Errorf("-no-tamper binary contains symbol %q", sym)
+	}
+	out, err = exec.Command("go", "test", "-cover").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go test failed: %s\n%s", err, out)
+	}
+	wantOut := []byte("coverage: 100.0% of statements")
+	if !bytes.Contains(out, wantOut) {
+		t.Errorf("go test output did not contain %q\n%s", wantOut, out)
+	}
+}
+
+func TestTypeFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t buildMode
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("-type=buildMode"); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	for _, name := range []string{"build_mode.go", "build_mode_test.go"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("could not stat %s: %s", name, err)
+		}
+	}
+	var tamper = []byte(`package main
+
+func (t buildMode) Testing() bool { return true }
+`)
+	if err := os.WriteFile("tamper.go", tamper, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("go", "run", ".").CombinedOutput()
+	if err == nil {
+		t.Fatal("go run . successful, want build failure")
+	}
+	wantErr := []byte("ambiguous selector buildModeProbe.Testing")
+	if !bytes.Contains(out, wantErr) {
+		t.Errorf("go run output did not contain %q\n%s", string(wantErr), out)
+	}
+}
+
+func TestNoModule(t *testing.T) {
+	chTempDir(t)
+	program := []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := run()
+	if err == nil {
+		t.Fatal("run() = <nil>, want error")
+	}
+	if !strings.Contains(err.Error(), "run go mod init") {
+		t.Errorf("run() = %q, want go mod init hint", err)
+	}
+}
+
+func TestNoDetector(t *testing.T) {
+	chTempDir(t)
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	var program = []byte(`package main
+
+import _ "example.com/pkg/lib"
+
+var t testingDetecter
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, "lib")
+	var lib = []byte(`package lib
+
+var t testingDetector
+`)
+	if err := os.WriteFile("lib.go", lib, 0644); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, "..")
+
+	// A single package must use the detector.
+	err := run()
+	if !errors.Is(err, detect.ErrNoDetector) {
+		t.Fatalf("run() = %v, want %q", err, detect.ErrNoDetector)
+	}
+	if _, err := os.Stat("testing_detector.go"); err == nil {
+		t.Error("testing_detector.go written into package without detector")
+	}
+
+	// Recursive generation skips it.
+	if err := run("-r"); err != nil {
+		t.Fatalf("run(-r) = %q, want <nil>", err)
+	}
+	if _, err := os.Stat("lib/testing_detector.go"); err != nil {
+		t.Errorf("lib/testing_detector.go not generated: %s", err)
+	}
+	if _, err := os.Stat("testing_detector.go"); err == nil {
+		t.Error("run(-r) generated into package without detector")
+	}
+}
+
+func TestTestCommand(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	for path, src := range map[string]string{
+		"main.go": "package main\n\nvar t testingDetector\n\nfunc main() {}\n",
+		"main_test.go": `package main
+
+import "testing"
+
+func TestDetector(tt *testing.T) {
+	if !t.Testing() {
+		tt.Error("Testing() = false, want true")
+	}
+}
+`,
+		"none/none.go": "package none\n",
+		"none/none_test.go": `package none
+
+import "testing"
+
+func TestNone(t *testing.T) { t.Fatal("tested a package without a detector") }
+`,
+	} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := exec.Command("go", "run", ".", "-C", dir, "test", "./...").
+		CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run . test ./... failed: %s\n%s", err, out)
+	}
+	for _, want := range []string{
+		"generated 1 packages, skipped 1 without testingDetector\n",
+		"ok  \texample.com/pkg\t",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("test output did not contain %q\n%s", want, out)
+		}
+	}
+	if bytes.Contains(out, []byte("example.com/pkg/none")) {
+		t.Errorf("test ran the tests of a package without a detector\n%s",
+			out)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	chTempDir(t)
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	for path, src := range map[string]string{
+		"a/a.go": "package a\n\nvar t aDetector\n",
+		"b/b.go": "package b\n\nvar t bDetector\n",
+		"c/c.go": "package c\n\nvar t testingDetector\n",
+		"testdetect.json": `{"targets": [
+	{"patterns": ["./a"], "type": "aDetector"},
+	{"patterns": ["./b"], "type": "bDetector", "method": "InTest"}
+]}`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, "c")
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err)
+	}
+	chdir(t, "..")
+	for path, want := range map[string]string{
+		"a/a_detector.go": "func (t aDetectorEmbed) Testing() bool",
+		"b/b_detector.go": "func (t bDetectorEmbed) InTest() bool",
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("%s did not contain %q\n%s", path, want, data)
+		}
+	}
+	if _, err := os.Stat("c/testing_detector.go"); err == nil {
+		t.Error("run() generated into c, which the config does not list")
+	}
+
+	// Flags override the config.
+	if err := run("-method=Detected"); err != nil {
+		t.Fatalf("run(-method=Detected) = %q, want <nil>", err)
+	}
+	data, err := os.ReadFile("b/b_detector.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte(") Detected() bool"); !bytes.Contains(data, want) {
+		t.Errorf("b/b_detector.go did not contain %q\n%s", want, data)
+	}
+
+	// Patterns override it entirely.
+	if err := run("./c"); err != nil {
+		t.Fatalf("run(./c) = %q, want <nil>", err)
+	}
+	if _, err := os.Stat("c/testing_detector.go"); err != nil {
+		t.Errorf("run(./c) did not generate into c: %s", err)
+	}
+}
+
+func TestConfigCompiler(t *testing.T) {
+	chTempDir(t)
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	gc, err := exec.LookPath("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program := "package main\n\nvar t testingDetector\n\nfunc main() {}\n"
+	config := func(tinygo string) {
+		t.Helper()
+		data, err := json.Marshal(map[string]any{"targets": []any{
+			map[string]any{"patterns": []string{"./a"}, "compiler": gc},
+			map[string]any{"patterns": []string{"./b"}, "compiler": tinygo},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile("testdetect.json", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "main.go")
+		if err := os.WriteFile(path, []byte(program), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only b is built with the missing compiler.
+	config(filepath.Join(t.TempDir(), "tinygo"))
+	err = run("-verify")
+	if err == nil || !strings.Contains(err.Error(), "could not run tinygo") {
+		t.Fatalf("run(-verify) = %v, want a tinygo error", err)
+	}
+	if strings.Contains(err.Error(), "a/") {
+		t.Errorf("run(-verify) built a with tinygo: %s", err)
+	}
+
+	tinygo, err := exec.LookPath("tinygo")
+	if err != nil {
+		t.Skip("tinygo not installed")
+	}
+	config(tinygo)
+	if err := run("-verify"); err != nil {
+		t.Fatalf("run(-verify) = %q, want <nil>", err)
+	}
+}
+
+func TestBuildBinaries(t *testing.T) {
+	chTempDir(t)
+	program := []byte(`package main
+
+func main() { println("ok") }
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if _, _, err := buildBinaries(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{outBin, outTestBin} {
+		if got, want := filepath.Ext(name) == ".exe",
+			runtime.GOOS == "windows"; got != want {
+			t.Errorf("%s has .exe suffix = %t on %s, want %t",
+				name, got, runtime.GOOS, want)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Windows has no executable bit; the suffix is what counts there.
+		if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+			t.Errorf("%s mode = %v, want executable", name, info.Mode())
+		}
+	}
+	if out, err := exec.Command("./" + outBin).CombinedOutput(); err != nil {
+		t.Errorf("%s failed: %s\n%s", outBin, err, out)
+	}
+}
+
+func TestBadTypeFlag(t *testing.T) {
+	chTempDir(t)
+	for _, name := range []string{"_", "1mode", "build-mode", "type"} {
+		err := run("-type=" + name)
+		if err == nil {
+			t.Errorf("run(-type=%q) = <nil>, want error", name)
+		} else if !strings.Contains(err.Error(), "bad type name") {
+			t.Errorf("run(-type=%q) = %q, want bad type name", name, err)
+		}
+	}
+}
+
+func TestMethodFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {
+	if t.InTest() {
+		println("t.InTest()=true")
+	} else {
+		println("t.InTest()=false")
+	}
+}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(t *testing.T) { main() }
+`)
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("-method=InTest"); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	bin, testbin, err := buildBinaries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := "t.InTest()=true"; bytes.Contains(bin, []byte(s)) {
+		t.Errorf("found %q in program binary", s)
+	}
+	if s := "t.InTest()=false"; !bytes.Contains(bin, []byte(s)) {
+		t.Errorf("missing %q in program binary", s)
+	}
+	if s := "t.InTest()=true"; !bytes.Contains(testbin, []byte(s)) {
+		t.Errorf("missing %q in test binary", s)
+	}
+	if s := "t.InTest()=false"; bytes.Contains(testbin, []byte(s)) {
+		t.Errorf("found %q in test binary", s)
+	}
+}
+
+func TestBadMethodFlag(t *testing.T) {
+	chTempDir(t)
+	for _, name := range []string{"_", "in-test", "func"} {
+		err := run("-method=" + name)
+		if err == nil {
+			t.Errorf("run(-method=%q) = <nil>, want error", name)
+		} else if !strings.Contains(err.Error(), "bad method name") {
+			t.Errorf("run(-method=%q) = %q, want bad method name", name, err)
+		}
+	}
+}
+
+func TestCheckFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("-check"); err == nil {
+		t.Errorf("run(-check) = <nil> before generation, want error")
+	}
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	if err := run("-check"); err != nil {
+		t.Errorf("run(-check) = %q after generation, want <nil>", err)
+	}
+	before, err := os.ReadFile("testing_detector.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := append(before, "// edited\n"...)
+	if err := os.WriteFile("testing_detector.go", stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("-check"); err == nil {
+		t.Errorf("run(-check) = <nil> after edit, want error")
+	}
+	if after, err := os.ReadFile("testing_detector.go"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(after, stale) {
+		t.Errorf("run(-check) modified testing_detector.go")
+	}
+}
+
+func TestStrictFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("-bench-detect"); err != nil {
+		t.Fatalf("run(-bench-detect) = %q, want <nil>", err.Error())
+	}
+	if err := run("-strict", "-bench-detect"); err != nil {
+		t.Errorf("run(-strict, -bench-detect) = %q, want <nil>", err)
+	}
+	// The files still declare Benchmarking, which is no longer asked for.
+	before, err := os.ReadFile("testing_detector.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run("-strict")
+	want := "testing_detector.go declares Benchmarking(), which is not " +
+		"configured"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("run(-strict) = %v, want error containing %q", err, want)
+	}
+	err = run("-strict", "-bench-detect", "-short-detect")
+	want = "testing_detector.go lacks Short(), which is configured"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("run(-strict, -bench-detect, -short-detect) = %v, "+
+			"want error containing %q", err, want)
+	}
+	if after, err := os.ReadFile("testing_detector.go"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(after, before) {
+		t.Errorf("run(-strict) modified testing_detector.go")
+	}
+}
+
+func TestStrictFlagLeftover(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	// Files of another mode are left over.
+	if err := run("-mode=buildtag"); err != nil {
+		t.Fatalf("run(-mode=buildtag) = %q, want <nil>", err.Error())
+	}
+	err := run("-strict")
+	want := "testing_detector_testdetect.go is left over"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("run(-strict) = %v, want error containing %q", err, want)
+	}
+	if err := run(); err != nil {
+		t.Fatalf("run() = %q, want <nil>", err.Error())
+	}
+	if err := os.Remove("testing_detector_testdetect.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("-strict"); err != nil {
+		t.Errorf("run(-strict) = %q after regeneration, want <nil>", err)
+	}
+}
+
+func TestDiffFlag(t *testing.T) {
+	dir := t.TempDir()
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	err := os.WriteFile(filepath.Join(dir, "main.go"), program, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	out, err := exec.Command("go", "run", ".", "-C", dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run . failed: %s\n%s", err, out)
+	}
+	path := filepath.Join(dir, "testing_detector.go")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "// edited\n"...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(dir, "testing_detector_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command("go", "run", ".", "-C", dir, "-diff").Output()
+	if err == nil {
+		t.Fatalf("go run . -diff succeeded with stale files\n%s", out)
+	}
+	for _, want := range []string{
+		"--- testing_detector.go\n+++ testing_detector.go\n@@ -",
+		"-// edited\n",
+		"--- " + os.DevNull + "\n+++ testing_detector_test.go\n@@ -0,0 +1,",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("go run . -diff output did not contain %q\n%s",
+				want, out)
+		}
+	}
+	if after, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(after, data) {
+		t.Errorf("go run . -diff modified testing_detector.go")
+	}
+}
+
+func TestDryRunFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	for _, flag := range []string{"-n", "-dry-run"} {
+		if err := run(flag); err != nil {
+			t.Fatalf("run(%s) = %q, want <nil>", flag, err.Error())
+		}
+		for _, name := range []string{
+			"testing_detector.go",
+			"testing_detector_test.go",
+		} {
+			if _, err := os.Stat(name); err == nil {
+				t.Errorf("run(%s) wrote %s", flag, name)
+			}
+		}
+	}
+}
+
+func TestRecursiveFlag(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	chdir(t, "cmd")
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, "..")
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("-r"); err != nil {
+		t.Fatalf("run(-r) = %q, want <nil>", err.Error())
+	}
+	if _, err := os.Stat("cmd/testing_detector.go"); err != nil {
+		t.Errorf("could not stat cmd/testing_detector.go: %s", err)
+	}
+	if err := run("-check", "./cmd"); err != nil {
+		t.Errorf("run(-check ./cmd) = %q, want <nil>", err)
+	}
+}
+
+func TestPatternArgs(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+var t testingDetector
+
+func main() {}
+`)
+	var lib = []byte(`package lib
+
+var t testingDetector
+
+func Testing() bool { return t.Testing() }
+`)
+	for _, f := range []struct{ dir, src string }{
+		{"cmd/a", string(program)},
+		{"cmd/b", string(program)},
+		{"internal/svc", strings.Replace(string(lib), "lib", "svc", 1)},
+		{"internal/other", strings.Replace(string(lib), "lib", "other", 1)},
+	} {
+		if err := os.MkdirAll(f.dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := os.WriteFile(f.dir+"/main.go", []byte(f.src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	if err := run("./internal/svc"); err != nil {
+		t.Fatalf("run(./internal/svc) = %q, want <nil>", err.Error())
+	}
+	if err := run("./cmd/..."); err != nil {
+		t.Fatalf("run(./cmd/...) = %q, want <nil>", err.Error())
+	}
+	for dir, want := range map[string]bool{
+		"cmd/a":          true,
+		"cmd/b":          true,
+		"internal/svc":   true,
+		"internal/other": false,
+	} {
+		_, err := os.Stat(dir + "/testing_detector.go")
+		if got := err == nil; got != want {
+			t.Errorf("%s/testing_detector.go exists = %t, want %t",
+				dir, got, want)
+		}
+	}
+}
+
+func TestVendor(t *testing.T) {
+	chTempDir(t)
+	var program = []byte(`package main
+
+import "example.com/b"
+
+var t testingDetector
+
+func main() {
+	if !t.Testing() {
+		b.Greet()
+	}
+}
+`)
+	var library = []byte(`package b
+
+func Greet() { println("Hello world!") }
+`)
+	for _, mod := range []struct {
+		dir  string
+		path string
+		src  []byte
+	}{
+		{"a", "example.com/a", program},
+		{"b", "example.com/b", library},
+	} {
+		chdir(t, mod.dir)
+		if err := os.WriteFile("main.go", mod.src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("go", "mod", "init", mod.path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+		}
+		chdir(t, "..")
+	}
+	chdir(t, "a")
+	for _, args := range [][]string{
+		{"mod", "edit", "-require=example.com/b@v0.0.0",
+			"-replace=example.com/b=../b"},
+		{"mod", "vendor"},
+	} {
+		cmd := exec.Command("go", args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go %s failed: %s\n%s", args[0], err, string(out))
+		}
+	}
+	// Only the vendored copy of example.com/b remains, and the network is
+	// off limits.
+	if err := os.RemoveAll("../b"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOPROXY", "off")
+	// With no -mod flag, the go command defaults to -mod=vendor.
+	for _, goflags := range []string{"", "-mod=vendor"} {
+		t.Setenv("GOFLAGS", goflags)
+		err := run("-verify", "-no-tamper", "-assert-no-testing")
+		if err != nil {
+			t.Fatalf("GOFLAGS=%q run(-verify -no-tamper -assert-no-testing) "+
+				"= %q, want <nil>", goflags, err)
+		}
+		bin, _, err := buildBinaries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := "Hello world!"; !bytes.Contains(bin, []byte(s)) {
+			t.Errorf("GOFLAGS=%q: missing %q in program binary", goflags, s)
+		}
+	}
+}
+
+func TestWorkspaceFlag(t *testing.T) {
+	chTempDir(t)
+	t.Setenv("GOWORK", "")
+	t.Setenv("GOFLAGS", "") // Workspace mode rejects -mod=mod.
+	var program = []byte(`package main
+
+import "example.com/b"
+
+var t testingDetector
+
+func main() { b.Greet() }
+`)
+	var library = []byte(`package b
+
+var t testingDetector
+
+func Greet() {
+	if !t.Testing() {
+		println("Hello world!")
+	}
+}
+`)
+	for _, mod := range []struct {
+		dir  string
+		path string
+		src  []byte
+	}{
+		{"a", "example.com/a", program},
+		{"b", "example.com/b", library},
+	} {
+		chdir(t, mod.dir)
+		if err := os.WriteFile("main.go", mod.src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("go", "mod", "init", mod.path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+		}
+		chdir(t, "..")
+	}
+	cmd := exec.Command("go", "work", "init", "./a", "./b")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go work init failed: %s\n%s", err, string(out))
+	}
+	if err := run("-workspace"); err != nil {
+		t.Fatalf("run(-workspace) = %q, want <nil>", err.Error())
+	}
+	for _, mod := range []string{"a", "b"} {
+		path := mod + "/testing_detector.go"
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("could not stat %s: %s", path, err)
+		}
+	}
+	if err := run("-workspace", "-check"); err != nil {
+		t.Errorf("run(-workspace -check) = %q, want <nil>", err)
+	}
+	cmd = exec.Command("go", "test", "./a", "./b")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("go test failed: %s\n%s", err, string(out))
+	}
+}
+
+func TestCodeCoverage(t *testing.T) {
 	chTempDir(t)
 	var program = []byte(`package main
 
@@ -21,8 +2056,9 @@ var t testingDetector
 func main() {
 	if t.Testing() {
 		println("t.Testing()=true")
-	} else {
-		println("t.Testing()=false")
+	}
+	if t.Coverage() {
+		println("t.Coverage()=true")
 	}
 	println("Hello world!")
 }
@@ -34,7 +2070,7 @@ func main() {
 
 import "testing"
 
-func TestMain(t *testing.T) { main() }
+func TestMain(_ *testing.T) { main() }
 `)
 	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
 		t.Fatal(err)
@@ -43,68 +2079,87 @@ func TestMain(t *testing.T) { main() }
 	if out, err := cmd.CombinedOutput(); err != nil {
 		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
 	}
-	if err := run(); err != nil {
+	if err := run("-cover-detect"); err != nil {
 		t.Fatalf("run() = %q, want <nil>", err.Error())
 	}
-	bin, testbin, err := buildBinaries()
+	cmd = exec.Command("go", "test", "-cover")
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		t.Fatal(err)
-	}
-
-	if s := "Hello world!"; !bytes.Contains(bin, []byte(s)) {
-		t.Errorf("missing %q in program binary", s)
+		t.Fatalf("go test failed: %s\n%s", err, out)
 	}
-	if s := "t.Testing()=true"; bytes.Contains(bin, []byte(s)) {
-		t.Errorf("found %q in program binary", s)
+	for _, want := range []string{
+		"coverage: 100.0% of statements",
+		"t.Coverage()=true",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("go test output did not contain %q\n%s", want, out)
+		}
 	}
-	if s := "t.Testing()=false"; !bytes.Contains(bin, []byte(s)) {
-		t.Errorf("missing %q in program binary", s)
+	out, err = exec.Command("go", "run", ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run failed: %s\n%s", err, out)
 	}
-
-	if s := "Hello world!"; !bytes.Contains(testbin, []byte(s)) {
-		t.Errorf("missing %q in test binary", s)
+	if s := []byte("t.Coverage()=true"); bytes.Contains(out, s) {
+		t.Errorf("go run output contained %q\n%s", s, out)
 	}
-	if s := "t.Testing()=true"; !bytes.Contains(testbin, []byte(s)) {
-		t.Errorf("missing %q in test binary", s)
+	cmd = exec.Command("go", "run", "-cover", ".")
+	cmd.Env = append(os.Environ(), "GOCOVERDIR="+t.TempDir())
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run -cover failed: %s\n%s", err, out)
 	}
-	if s := "t.Testing()=false"; bytes.Contains(testbin, []byte(s)) {
-		t.Errorf("found %q in test binary", s)
+	if s := []byte("t.Coverage()=true"); !bytes.Contains(out, s) {
+		t.Errorf("go run -cover output did not contain %q\n%s", s, out)
 	}
 }
 
-func TestTamperDetection(t *testing.T) {
+func TestCoverExcludeFlag(t *testing.T) {
 	chTempDir(t)
 	var program = []byte(`package main
 
 var t testingDetector
 
-func (t testingDetector) Testing() bool { return true }
-
-func main() {}
+func main() { println("race:", t.Race()) }
 `)
 	if err := os.WriteFile("main.go", program, 0644); err != nil {
 		t.Fatal(err)
 	}
+	var tests = []byte(`package main
+
+import "testing"
+
+func TestMain(_ *testing.T) { main() }
+`)
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
 	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
 	if out, err := cmd.CombinedOutput(); err != nil {
 		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
 	}
-	if err := run(); err != nil {
-		t.Fatalf("run() = %q, want <nil>", err.Error())
-	}
-	out, err := exec.Command("go", "run", ".").CombinedOutput()
-	if err == nil {
-		t.Fatal("go run . successful, want panic")
-	} else if ee := new(exec.ExitError); !errors.As(err, &ee) {
-		t.Fatalf("go run failed unexpectedly: %s", err)
-	}
-	wantErr := []byte("bad testingDetector state: got true, want false")
-	if !bytes.Contains(out, wantErr) {
-		t.Errorf("go run output did not contain %q\n%s", string(wantErr), out)
+	for _, tt := range []struct {
+		args []string
+		full bool
+	}{
+		{[]string{"-race-detect", "-backing=func"}, false},
+		{[]string{"-race-detect", "-backing=func", "-cover-exclude"}, true},
+	} {
+		if err := run(tt.args...); err != nil {
+			t.Fatalf("run(%q) = %q, want <nil>", tt.args, err.Error())
+		}
+		out, err := exec.Command("go", "test", "-cover").CombinedOutput()
+		if err != nil {
+			t.Fatalf("go test failed: %s\n%s", err, out)
+		}
+		full := []byte("coverage: 100.0% of statements")
+		if got := bytes.Contains(out, full); got != tt.full {
+			t.Errorf("run(%q): go test -cover reported full coverage = "+
+				"%t, want %t\n%s", tt.args, got, tt.full, out)
+		}
 	}
 }
 
-func TestCodeCoverage(t *testing.T) {
+func TestTestBinary(t *testing.T) {
 	chTempDir(t)
 	var program = []byte(`package main
 
@@ -113,8 +2168,9 @@ var t testingDetector
 func main() {
 	if t.Testing() {
 		println("t.Testing()=true")
+	} else {
+		println("t.Testing()=false")
 	}
-	println("Hello world!")
 }
 `)
 	if err := os.WriteFile("main.go", program, 0644); err != nil {
@@ -124,7 +2180,7 @@ func main() {
 
 import "testing"
 
-func TestMain(_ *testing.T) { main() }
+func TestMain(t *testing.T) { main() }
 `)
 	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
 		t.Fatal(err)
@@ -136,14 +2192,31 @@ func TestMain(_ *testing.T) { main() }
 	if err := run(); err != nil {
 		t.Fatalf("run() = %q, want <nil>", err.Error())
 	}
-	cmd = exec.Command("go", "test", "-cover")
-	out, err := cmd.CombinedOutput()
+	if _, _, err := buildBinaries(); err != nil {
+		t.Fatal(err)
+	}
+	// The compiled test binary is a test binary however it is started,
+	// with or without test flags and outside the package directory.
+	testbin, err := filepath.Abs(outTestBin)
 	if err != nil {
-		t.Fatalf("go test failed: %s\n%s", err, out)
+		t.Fatal(err)
 	}
-	wantOut := []byte("coverage: 100.0% of statements")
-	if !bytes.Contains(out, wantOut) {
-		t.Errorf("go test output did not contain %q\n%s", string(wantOut), out)
+	for _, args := range [][]string{nil, {"-test.v", "-test.run=TestMain"}} {
+		cmd := exec.Command(testbin, args...)
+		cmd.Dir = t.TempDir()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Errorf("out.test %q failed: %s\n%s", args, err, out)
+		} else if s := "t.Testing()=true"; !bytes.Contains(out, []byte(s)) {
+			t.Errorf("out.test %q output did not contain %q\n%s",
+				args, s, out)
+		}
+	}
+	out, err := exec.Command("./" + outBin).CombinedOutput()
+	if err != nil {
+		t.Errorf("out failed: %s\n%s", err, out)
+	} else if s := "t.Testing()=false"; !bytes.Contains(out, []byte(s)) {
+		t.Errorf("out output did not contain %q\n%s", s, out)
 	}
 }
 
@@ -178,6 +2251,8 @@ func TestMain(t *testing.T) { main() }
 
 import "fmt"
 
+var _ testingDetector
+
 func Greet(s string) string { return fmt.Sprintf("Hello, %s!", s) }
 `)
 	if err := os.WriteFile("lib.go", lib, 0644); err != nil {
@@ -218,6 +2293,93 @@ func TestGreet(_ *testing.T) { Greet("Hello") }
 	}
 }
 
+func TestPackageFlag(t *testing.T) {
+	chTempDir(t)
+	cmd := exec.Command("go", "mod", "init", "example.com/pkg")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go mod init failed: %s\n%s", err, string(out))
+	}
+	var program = []byte(`package main
+
+import "example.com/pkg/internal/testdetect"
+
+func main() {
+	println("testdetect.Testing() =", testdetect.Testing())
+}
+`)
+	if err := os.WriteFile("main.go", program, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []byte(`package main
+
+import (
+	"testing"
+
+	"example.com/pkg/internal/testdetect"
+)
+
+func TestMain(t *testing.T) {
+	if !testdetect.Testing() {
+		t.Error("testdetect.Testing() = false, want true")
+	}
+}
+`)
+	if err := os.WriteFile("main_test.go", tests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := run("-package", "internal/testdetect", "-no-tamper",
+		"-assert-no-testing")
+	if err != nil {
+		t.Errorf("run(-package internal/testdetect -no-tamper "+
+			"-assert-no-testing) = %q, want <nil>", err.Error())
+	}
+	if err := run("-package", "internal/testdetect"); err != nil {
+		t.Fatalf("run(-package internal/testdetect) = %q, want <nil>",
+			err.Error())
+	}
+	for _, name := range []string{
+		"testing_detector_hook_test.go",
+		"internal/testdetect/testing_detector.go",
+		"internal/testdetect/testing_detector_test.go",
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("could not stat %s: %s", name, err)
+		}
+	}
+	out, err := exec.Command("go", "run", ".").CombinedOutput()
+	if err != nil {
+		t.Errorf("go run failed: %s\n%s", err, out)
+	} else if want := []byte("testdetect.Testing() = false"); !bytes.Contains(
+		out, want,
+	) {
+		t.Errorf("go run output did not contain %q\n%s", string(want), out)
+	}
+	out, err = exec.Command("go", "test", "./...").CombinedOutput()
+	if err != nil {
+		t.Errorf("go test failed: %s\n%s", err, out)
+	}
+
+	// Once the subpackage exists, generation scans it like any other, and
+	// still refuses to generate over a method that would tamper with it.
+	if err := run("-check", "-package", "internal/testdetect"); err != nil {
+		t.Errorf("run(-check -package internal/testdetect) = %q, want <nil>",
+			err.Error())
+	}
+	var tamper = []byte(`package testdetect
+
+func (testingDetector) Testing() bool { return true }
+`)
+	err = os.WriteFile("internal/testdetect/tamper.go", tamper, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run("-package", "internal/testdetect")
+	if !errors.Is(err, detect.ErrTamper) {
+		t.Errorf("run(-package internal/testdetect) = %v, want tamper error",
+			err)
+	}
+}
+
 func chTempDir(t *testing.T) {
 	dir := t.TempDir()
 	wd, err := os.Getwd()
@@ -239,30 +2401,33 @@ func chdir(t *testing.T, dir string) {
 	}
 }
 
+// Names of the binaries written by buildBinaries.
+var (
+	outBin     = exe("out")
+	outTestBin = exe("out.test")
+)
+
+// exe returns name with the executable suffix of the host, since the
+// binaries tests build are run in place.
+func exe(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// buildBinaries builds the package in the working directory with
+// [detect.BuildBinaries] and writes the binaries to outBin and outTestBin,
+// so that tests can run them.
 func buildBinaries() (bin, testbin []byte, err error) {
-	gc := cmp.Or(os.Getenv("GOCOMPILER"), "go")
-	var g errgroup.Group
-	g.Go(func() error {
-		cmd := exec.Command(gc, "build", "-o", "out", ".")
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("go build failed: %w\n%s", err, string(out))
-		}
-		var err error
-		if bin, err = os.ReadFile("out"); err != nil {
-			return err
-		}
-		return nil
-	})
-	g.Go(func() error {
-		cmd := exec.Command(gc, "test", "-c", "-o", "out.test", ".")
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("go test -c failed: %w\n%s", err, string(out))
-		}
-		var err error
-		if testbin, err = os.ReadFile("out.test"); err != nil {
-			return err
-		}
-		return nil
-	})
-	return bin, testbin, g.Wait()
+	if bin, testbin, err = detect.BuildBinaries("."); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(outBin, bin, 0755); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(outTestBin, testbin, 0755); err != nil {
+		return nil, nil, err
+	}
+	return bin, testbin, nil
 }
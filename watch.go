@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often watch looks for changes, and how long the files must stay
+// unchanged before it regenerates, so that a burst of saves regenerates once.
+var (
+	watchInterval = 250 * time.Millisecond
+	watchDebounce = 200 * time.Millisecond
+)
+
+// A fileState is what watch compares to tell that a file changed.
+type fileState struct {
+	mod  time.Time
+	size int64
+}
+
+// watch calls generate, then again whenever the Go files in dirs change,
+// until ctx is done. With recursive, it also watches their subdirectories,
+// other than those the go command ignores. It polls rather than relying on
+// file system notifications, which are not available everywhere. Errors are
+// written to stderr without stopping the watch, since the packages are often
+// broken halfway through an edit.
+func watch(
+	ctx context.Context, dirs []string, recursive bool,
+	generate func() error, stderr io.Writer,
+) error {
+	var last map[string]fileState
+	regenerate := func() {
+		// Snapshot before generating, so that no edit made while it runs
+		// goes unnoticed. The generated files changing then triggers one
+		// more run, which leaves them alone.
+		var err error
+		if last, err = goFiles(dirs, recursive); err != nil {
+			fmt.Fprintf(stderr, "testdetect: %s\n", err)
+		}
+		if err := generate(); err != nil {
+			fmt.Fprintf(stderr, "testdetect: %s\n", err)
+		}
+	}
+	regenerate()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		cur, err := goFiles(dirs, recursive)
+		if err != nil || maps.Equal(cur, last) {
+			continue
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchDebounce):
+			}
+			next, err := goFiles(dirs, recursive)
+			if err != nil || maps.Equal(next, cur) {
+				break
+			}
+			cur = next
+		}
+		regenerate()
+	}
+}
+
+// goFiles returns the state of each Go file in dirs, and with recursive in
+// their subdirectories, by path.
+func goFiles(dirs []string, recursive bool) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(
+			path string, e fs.DirEntry, err error,
+		) error {
+			if err != nil {
+				if path != dir && errors.Is(err, fs.ErrNotExist) {
+					// Removed since its parent was read.
+					return nil
+				}
+				return err
+			}
+			if e.IsDir() {
+				if path == dir {
+					return nil
+				}
+				name := e.Name()
+				if !recursive || name == "vendor" || name == "testdata" ||
+					strings.HasPrefix(name, ".") ||
+					strings.HasPrefix(name, "_") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(path) != ".go" {
+				return nil
+			}
+			info, err := e.Info()
+			if err != nil {
+				// Removed since the directory was read.
+				return nil
+			}
+			files[path] = fileState{info.ModTime(), info.Size()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}